@@ -0,0 +1,152 @@
+package gtpl
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Returned by MergeBlocks() when both templates have a block of the same name.
+var ErrBlockConflict = errors.New("gtpl: block already exists")
+
+// The name that refers to the root of a template, the content outside of any
+// block. Parse(RootBlock) renders it in place, and GetBlockSource() and
+// SetBlock() read and replace it. It's a name like any block name rather than
+// the internal key of the root, so it keeps working however the root is
+// stored.
+const RootBlock = ""
+
+// The key a block name is stored under in tpl.blocks
+func blockKey(block_name string) string {
+	if block_name == RootBlock {
+		return "[_GTPL_ROOT_]"
+	}
+	return "[_GTPL_ROOT_]." + block_name
+}
+
+// Render the root content in place with the current assignments. Blocks
+// stay where they are, so they can still be parsed into it afterwards.
+func (tpl *TPL) parseRoot() error {
+	defer tpl.snapshotGlobals()()
+
+	content_results := tpl.assignments(tpl.blocks["[_GTPL_ROOT_]"])
+	content_results = tpl.handlers(content_results)
+	if tpl.aborted != nil {
+		return tpl.aborted
+	}
+
+	tpl.blocks["[_GTPL_ROOT_]"] = content_results
+	return nil
+}
+
+// The source of a block as it is now, with the blocks nested in it written
+// back out as block directives. Content already parsed into the block shows
+// up as rendered text.
+func (tpl *TPL) GetBlockSource(block_name string) (string, error) {
+	key := blockKey(block_name)
+	if _, ok := tpl.blocks[key]; !ok {
+		return "", fmt.Errorf("%w: %s", ErrBlockNotFound, block_name)
+	}
+
+	// Escapes are written the way a template body would have them
+	return strings.Replace(stripArgs(tpl.blockSource(key)), sanitize_mark, "\\", -1), nil
+}
+
+// Write a block's content back out with its children as block directives
+func (tpl *TPL) blockSource(key string) string {
+	place_holder_pattern := compile(regexp.QuoteMeta("[_GTPL_ROOT_].") + "[A-Za-z0-9_\\-\\.]+\x00")
+
+	return place_holder_pattern.ReplaceAllStringFunc(tpl.blocks[key], func(place_holder string) string {
+		child_key := strings.TrimSuffix(place_holder, "\x00")
+		name := strings.TrimPrefix(child_key, key+".")
+		if name == child_key || strings.Contains(name, ".") {
+			return place_holder
+		}
+
+		return directive_prefix + " block: " + name + " -->" + tpl.blockSource(child_key) + directive_prefix + " /block: " + name + " -->"
+	})
+}
+
+// Replace a block's content with new source, which may contain blocks of its
+// own. The blocks that were nested in it are dropped.
+func (tpl *TPL) SetBlock(block_name string, source string) error {
+	key := blockKey(block_name)
+	if _, ok := tpl.blocks[key]; !ok {
+		return fmt.Errorf("%w: %s", ErrBlockNotFound, block_name)
+	}
+
+	if err := sandboxCheck(source); err != nil {
+		return err
+	}
+	if err := validate(source); err != nil {
+		return err
+	}
+
+	for child_key := range tpl.blocks {
+		if strings.HasPrefix(child_key, key+".") {
+			delete(tpl.blocks, child_key)
+		}
+	}
+
+	tpl.blocks[key] = normalize(escapeTemplate(source))
+	return tpl.preprocess(key, strings.Count(key, "."))
+}
+
+// Run one block's content through the render steps on its own, variable and
+// conditional substitution, handlers and cleanup, and return the final text.
+// Values are sanitized like assignments and globals here take the place of
+// the package globals. This is meant for testing the substitution in a
+// template without opening one, block directives in content aren't split out.
+func ProcessBlock(content string, locals map[string]string, globals map[string]string) string {
+	tpl := TPL{}
+	tpl.setup()
+
+	tpl.globals = make(map[string]string, len(globals))
+	for variable, value := range globals {
+		tpl.globals[variable] = assignable(value)
+	}
+	tpl.AssignMany(locals)
+
+	content_results := tpl.assignments(escapeTemplate(content))
+	content_results = tpl.handlers(content_results)
+
+	return tpl.output(tpl.cleanup(content_results))
+}
+
+// Copy the top level blocks of another template, along with the blocks nested
+// in them, into this one, for assembling a page from blocks that plugins
+// provide. Nothing is merged if a block of the same name already has content
+// here, that's reported with ErrBlockConflict. An empty block such as
+// <!-- block: sidebar --><!-- /block: sidebar --> marks where a merged block
+// goes, parsing the merged block places it there. Merged blocks without such
+// a spot can still be rendered with RenderBlock() or AddBlockHandler().
+func (tpl *TPL) MergeBlocks(other *TPL) error {
+	tpl.setup()
+
+	var names []string
+	for key := range other.blocks {
+		name := strings.TrimPrefix(key, "[_GTPL_ROOT_].")
+		if name == key || strings.Contains(name, ".") {
+			continue
+		}
+		if content, ok := tpl.blocks[blockKey(name)]; ok && strings.TrimSpace(content) != "" {
+			return fmt.Errorf("%w: %s", ErrBlockConflict, name)
+		}
+		names = append(names, name)
+	}
+
+	for _, name := range names {
+		key := blockKey(name)
+		for other_key, content := range other.blocks {
+			if other_key == key || strings.HasPrefix(other_key, key+".") {
+				tpl.blocks[other_key] = content
+				if fallback, ok := other.fallbacks[other_key]; ok {
+					tpl.SetBlockFallback(strings.TrimPrefix(other_key, "[_GTPL_ROOT_]."), fallback)
+				}
+			}
+		}
+	}
+
+	return nil
+}
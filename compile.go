@@ -0,0 +1,304 @@
+package gtpl
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A template parsed once to be rendered many times. Renders work on their own
+// copy of the blocks, so a Template can be shared between goroutines.
+type Template struct {
+	blocks map[string]string
+	source []byte
+
+	// Rendered outputs from Render(), when output caching is on
+	outputs       map[[sha256.Size]byte]cachedOutput
+	outputs_order [][sha256.Size]byte
+	outputs_size  int
+	outputs_ttl   time.Duration
+	outputs_mutex sync.Mutex
+}
+
+// A rendered output and when it stops being valid
+type cachedOutput struct {
+	content string
+	expires time.Time
+}
+
+// Parse a template once for rendering many times. It takes the same arguments
+// as Open().
+func Compile(vArgs ...interface{}) (*Template, error) {
+	name, fbuffer, err := openParams(vArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	// What includes pull in depends on more than the content, so templates
+	// with includes are compiled every time
+	cacheable := !includePattern().Match(fbuffer)
+
+	key := sha256.Sum256([]byte(directive_prefix + "\x00" + strconv.FormatBool(sandboxed()) + "\x00" + string(fbuffer)))
+	if cacheable {
+		if cached := cachedTemplate(key); cached != nil {
+			// Only the parsed blocks are shared, every caller gets its own
+			// output cache
+			return &Template{blocks: cached.blocks, source: cached.source}, nil
+		}
+	}
+
+	tpl, err := load(nil, name, fbuffer)
+	if err != nil {
+		return nil, err
+	}
+
+	if cacheable {
+		cacheTemplate(key, &Template{blocks: tpl.blocks, source: tpl.source})
+	}
+	return &Template{blocks: tpl.blocks, source: tpl.source}, nil
+}
+
+// Compiled templates keyed by a hash of their content, oldest first in
+// compile_cache_order so the oldest is dropped once the cache is full
+var compile_cache = make(map[[sha256.Size]byte]*Template)
+var compile_cache_order [][sha256.Size]byte
+var compile_cache_size = 0
+var compile_cache_mutex sync.Mutex
+
+// Let Compile() parse identical content once, wherever it was loaded from,
+// keeping up to size templates. The Templates it returns share the parsed
+// blocks but not their output caches. The cache is keyed by the
+// content, so templates with includes aren't cached, what they include depends
+// on the template directory and the files themselves. A size of 0, the
+// default, turns the cache off.
+func SetCompileCacheSize(size int) {
+	compile_cache_mutex.Lock()
+	defer compile_cache_mutex.Unlock()
+
+	compile_cache_size = size
+	evictTemplates()
+}
+
+// Drop every template from the compile cache
+func ClearCompileCache() {
+	compile_cache_mutex.Lock()
+	defer compile_cache_mutex.Unlock()
+
+	compile_cache = make(map[[sha256.Size]byte]*Template)
+	compile_cache_order = nil
+}
+
+// Find a compiled template in the cache, nil when there isn't one
+func cachedTemplate(key [sha256.Size]byte) *Template {
+	compile_cache_mutex.Lock()
+	defer compile_cache_mutex.Unlock()
+
+	return compile_cache[key]
+}
+
+// Store a compiled template in the cache, if the cache is on
+func cacheTemplate(key [sha256.Size]byte, compiled *Template) {
+	compile_cache_mutex.Lock()
+	defer compile_cache_mutex.Unlock()
+
+	if compile_cache_size <= 0 {
+		return
+	}
+	if _, ok := compile_cache[key]; !ok {
+		compile_cache_order = append(compile_cache_order, key)
+	}
+	compile_cache[key] = compiled
+	evictTemplates()
+}
+
+// Drop the oldest templates until the cache fits its size
+func evictTemplates() {
+	for len(compile_cache_order) > 0 && len(compile_cache_order) > compile_cache_size {
+		delete(compile_cache, compile_cache_order[0])
+		compile_cache_order = compile_cache_order[1:]
+	}
+}
+
+// A fresh TPL to render, without parsing the template again
+func (compiled *Template) New() TPL {
+	tpl := TPL{source: compiled.source}
+	tpl.setup()
+
+	for key, content := range compiled.blocks {
+		tpl.blocks[key] = content
+	}
+
+	return tpl
+}
+
+// Render the template with data filling the variables outside of blocks. The
+// values are sanitized like any assignment. Blocks aren't parsed and drop out
+// of the output, use New() to drive blocks with Parse() yourself. A handler
+// that aborts the render or keeps expanding is reported the way OutErr()
+// reports it.
+func (compiled *Template) Render(data map[string]string) (string, error) {
+	key, cached := compiled.cachedOutput(data)
+	if cached != nil {
+		return *cached, nil
+	}
+
+	tpl := compiled.New()
+	tpl.WithScopedGlobals()
+
+	for variable, value := range data {
+		tpl.AssignGlobal(variable, value)
+	}
+
+	tpl.blocks["[_GTPL_ROOT_]"] = tpl.assignments(tpl.blocks["[_GTPL_ROOT_]"])
+
+	content, err := tpl.OutErr()
+	if err != nil {
+		return "", err
+	}
+	compiled.cacheOutput(key, content)
+	return content, nil
+}
+
+// Cache the outputs of Render(), keeping up to size outputs for ttl each, for
+// pages that rarely change. Outputs are keyed by the data, the package globals
+// and SetSafeDefault() they were rendered with, handlers aren't part of the
+// key, so pages with handlers whose output changes need a short ttl or
+// InvalidateOutputs(). A size of 0, the default, turns the cache off.
+func (compiled *Template) SetOutputCache(size int, ttl time.Duration) {
+	compiled.outputs_mutex.Lock()
+	defer compiled.outputs_mutex.Unlock()
+
+	compiled.outputs_size = size
+	compiled.outputs_ttl = ttl
+	compiled.evictOutputs()
+}
+
+// Drop every cached output
+func (compiled *Template) InvalidateOutputs() {
+	compiled.outputs_mutex.Lock()
+	defer compiled.outputs_mutex.Unlock()
+
+	compiled.outputs = nil
+	compiled.outputs_order = nil
+}
+
+// The cache key for rendering data, and the cached output for it if there is
+// one that hasn't expired
+func (compiled *Template) cachedOutput(data map[string]string) ([sha256.Size]byte, *string) {
+	compiled.outputs_mutex.Lock()
+	defer compiled.outputs_mutex.Unlock()
+
+	if compiled.outputs_size <= 0 {
+		return [sha256.Size]byte{}, nil
+	}
+
+	globals_mutex.RLock()
+	globals := copyMap(globalassignments)
+	globals_mutex.RUnlock()
+
+	// Length prefixed so no two sets of values hash the same
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%t;", safe_default)
+	for _, variables := range []map[string]string{data, globals} {
+		names := make([]string, 0, len(variables))
+		for variable := range variables {
+			names = append(names, variable)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintf(hash, "%d;", len(names))
+		for _, variable := range names {
+			fmt.Fprintf(hash, "%d:%s%d:%s", len(variable), variable, len(variables[variable]), variables[variable])
+		}
+	}
+
+	var key [sha256.Size]byte
+	copy(key[:], hash.Sum(nil))
+
+	if output, ok := compiled.outputs[key]; ok && time.Now().Before(output.expires) {
+		return key, &output.content
+	}
+	return key, nil
+}
+
+// Store a rendered output, if the cache is on
+func (compiled *Template) cacheOutput(key [sha256.Size]byte, content string) {
+	compiled.outputs_mutex.Lock()
+	defer compiled.outputs_mutex.Unlock()
+
+	if compiled.outputs_size <= 0 {
+		return
+	}
+	if compiled.outputs == nil {
+		compiled.outputs = make(map[[sha256.Size]byte]cachedOutput)
+	}
+	if _, ok := compiled.outputs[key]; !ok {
+		compiled.outputs_order = append(compiled.outputs_order, key)
+	}
+	compiled.outputs[key] = cachedOutput{content: content, expires: time.Now().Add(compiled.outputs_ttl)}
+	compiled.evictOutputs()
+}
+
+// Drop the oldest outputs until the cache fits its size
+func (compiled *Template) evictOutputs() {
+	for len(compiled.outputs_order) > 0 && len(compiled.outputs_order) > compiled.outputs_size {
+		delete(compiled.outputs, compiled.outputs_order[0])
+		compiled.outputs_order = compiled.outputs_order[1:]
+	}
+}
+
+// Render the template once per dataset, like Render(), returning the outputs
+// in the same order. Datasets are rendered in parallel by up to GOMAXPROCS
+// workers. The first error stops the remaining renders and is returned.
+func (compiled *Template) RenderEach(datasets []map[string]string) ([]string, error) {
+	results := make([]string, len(datasets))
+
+	jobs := make(chan int)
+	var wait sync.WaitGroup
+	var failure error
+	var failure_once sync.Once
+	done := make(chan struct{})
+
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(datasets) {
+		workers = len(datasets)
+	}
+
+	for worker := 0; worker < workers; worker++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for index := range jobs {
+				output, err := compiled.Render(datasets[index])
+				if err != nil {
+					failure_once.Do(func() {
+						failure = err
+						close(done)
+					})
+					continue
+				}
+				results[index] = output
+			}
+		}()
+	}
+
+queue:
+	for index := range datasets {
+		select {
+		case jobs <- index:
+		case <-done:
+			break queue
+		}
+	}
+	close(jobs)
+	wait.Wait()
+
+	if failure != nil {
+		return nil, failure
+	}
+	return results, nil
+}
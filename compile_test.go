@@ -0,0 +1,114 @@
+package gtpl
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRenderEach(t *testing.T) {
+	compiled, err := Compile([]byte(`<p>{name}</p>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputs, err := compiled.RenderEach([]map[string]string{{"name": "a"}, {"name": "b"}, {"name": "<c>"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"<p>a</p>", "<p>b</p>", "<p><c></p>"}
+	for index := range want {
+		if outputs[index] != want[index] {
+			t.Errorf("output %d = %q, want %q", index, outputs[index], want[index])
+		}
+	}
+}
+
+func TestRenderEachReportsAbort(t *testing.T) {
+	failed := errors.New("redirect")
+	AddContextHandler("render_each_abort", func(tpl *TPL) string {
+		if name, _ := tpl.lookup("name"); name == "b" {
+			tpl.Abort(failed)
+		}
+		return ""
+	})
+
+	compiled, _ := Compile([]byte(`{name}<!-- handler: render_each_abort -->`))
+	if _, err := compiled.RenderEach([]map[string]string{{"name": "a"}, {"name": "b"}}); !errors.Is(err, failed) {
+		t.Errorf("RenderEach() = %v, want the abort error", err)
+	}
+}
+
+func TestCompileCache(t *testing.T) {
+	SetCompileCacheSize(10)
+	defer SetCompileCacheSize(0)
+	defer ClearCompileCache()
+
+	first, _ := Compile([]byte(`<p>{name}</p>`))
+	second, _ := Compile([]byte(`<p>{name}</p>`))
+	if reflect.ValueOf(first.blocks).Pointer() != reflect.ValueOf(second.blocks).Pointer() {
+		t.Errorf("identical content wasn't compiled once")
+	}
+}
+
+func TestOutputCacheIsPerCompile(t *testing.T) {
+	SetCompileCacheSize(10)
+	defer SetCompileCacheSize(0)
+	defer ClearCompileCache()
+
+	cached, _ := Compile([]byte(`<p>{name}</p>`))
+	cached.SetOutputCache(10, time.Hour)
+	other, _ := Compile([]byte(`<p>{name}</p>`))
+
+	if got, _ := cached.Render(map[string]string{"name": "a"}); got != "<p>a</p>" {
+		t.Fatalf("got %q, want %q", got, "<p>a</p>")
+	}
+	if other.outputs != nil {
+		t.Errorf("output cache is shared with another Compile() of the same content")
+	}
+}
+
+func TestOutputCacheKeysSafeDefault(t *testing.T) {
+	defer SetSafeDefault(false)
+
+	compiled, _ := Compile([]byte(`<p>{name}</p>`))
+	compiled.SetOutputCache(10, time.Hour)
+	data := map[string]string{"name": "<b>"}
+
+	SetSafeDefault(false)
+	if got, _ := compiled.Render(data); got != "<p><b></p>" {
+		t.Errorf("got %q, want %q", got, "<p><b></p>")
+	}
+	SetSafeDefault(true)
+	if got, _ := compiled.Render(data); got != "<p>&lt;b&gt;</p>" {
+		t.Errorf("got %q, want %q", got, "<p>&lt;b&gt;</p>")
+	}
+}
+
+func TestCompileCacheSkipsIncludes(t *testing.T) {
+	SetCompileCacheSize(10)
+	defer SetCompileCacheSize(0)
+	defer ClearCompileCache()
+	defer SetTemplateDir("")
+
+	source := []byte(`<!-- include: part.html -->`)
+	for _, text := range []string{"first", "second"} {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "part.html"), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		SetTemplateDir(dir)
+
+		compiled, err := Compile(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := compiled.Render(nil); got != text {
+			t.Errorf("got %q, want %q", got, text)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package gtpl
+
+import (
+	"regexp"
+)
+
+// Resolve conditionals, <!-- if: name -->shown<!-- else -->hidden<!-- /if -->.
+// A variable counts as set when it has a non-empty value, looked up the same
+// way a plain token is. Nested conditionals are resolved innermost first and
+// tags without a partner are left alone.
+func (tpl *TPL) conditionals(content_results string) string {
+	if_pattern := compile(regexp.QuoteMeta(directive_prefix) + `\s*if\s*:\s*([A-Za-z0-9_\-\.]+)\s*-->`)
+	else_pattern := compile(regexp.QuoteMeta(directive_prefix) + `\s*else\s*-->`)
+	end_pattern := compile(regexp.QuoteMeta(directive_prefix) + `\s*/if\s*-->`)
+
+	// Closing tags before offset have no if to pair with
+	offset := 0
+
+	for {
+		end := end_pattern.FindStringIndex(content_results[offset:])
+		if end == nil {
+			return content_results
+		}
+		end[0], end[1] = end[0]+offset, end[1]+offset
+
+		// The last if before the first /if has no other conditional inside it
+		opens := if_pattern.FindAllStringSubmatchIndex(content_results[offset:end[0]], -1)
+		if opens == nil {
+			offset = end[1]
+			continue
+		}
+		open := opens[len(opens)-1]
+		for index := range open {
+			open[index] += offset
+		}
+
+		body := content_results[open[1]:end[0]]
+		shown, hidden := body, ""
+		if index := else_pattern.FindStringIndex(body); index != nil {
+			shown, hidden = body[:index[0]], body[index[1]:]
+		}
+
+		value, ok := argsAt(content_results, open[0]).lookup(content_results[open[2]:open[3]])
+		if !ok {
+			value, _ = tpl.lookup(content_results[open[2]:open[3]])
+		}
+		if value == "" {
+			shown = hidden
+		}
+
+		content_results = content_results[:open[0]] + shown + content_results[end[1]:]
+	}
+}
+
+// Assign a flag for conditionals. When on the variable is set to "true" so
+// <!-- if: variable --> shows its content, when off any value it had is
+// removed so the <!-- else --> side is shown instead.
+func (tpl *TPL) AssignFlag(variable string, on bool) {
+	if on {
+		tpl.Assign(variable, "true")
+		return
+	}
+	tpl.setup()
+	delete(tpl.LocalAssignments, variable)
+}
+
+// Assign form validation messages, keyed by field name, as error_<field> so
+// each field can show its own message:
+//
+//	<!-- if: error_email --><p class="error">{error_email}</p><!-- /if -->
+//
+// Fields without a message have no error_ variable and the conditional drops
+// out. The messages are sanitized like any assignment.
+func (tpl *TPL) AssignErrors(errs map[string]string) {
+	for field, message := range errs {
+		tpl.Assign("error_"+field, message)
+	}
+}
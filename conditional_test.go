@@ -0,0 +1,45 @@
+package gtpl
+
+import (
+	"testing"
+)
+
+func TestConditionals(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		flag   bool
+		want   string
+	}{
+		{"root on", `<!-- if: show -->YES<!-- else -->NO<!-- /if -->`, true, "YES"},
+		{"root off", `<!-- if: show -->YES<!-- else -->NO<!-- /if -->`, false, "NO"},
+		{"root without else", `[<!-- if: show -->YES<!-- /if -->]`, false, "[]"},
+		{"nested", `<!-- if: show -->A<!-- if: other -->B<!-- /if -->C<!-- /if -->`, true, "AC"},
+		{"block", `<!-- block: b --><!-- if: show -->YES<!-- else -->NO<!-- /if --><!-- /block: b -->`, true, "YES"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tpl, err := Open([]byte(test.source))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tpl.AssignFlag("show", test.flag)
+			tpl.Parse("b")
+
+			if got := tpl.Out(); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAssignErrorsOutsideBlocks(t *testing.T) {
+	tpl, _ := Open([]byte(`<input name="email"<!-- if: error_email --> class="invalid"<!-- /if -->><input name="name"<!-- if: error_name --> class="invalid"<!-- /if -->>`))
+	tpl.AssignErrors(map[string]string{"email": "Enter an email address"})
+
+	want := `<input name="email" class="invalid"><input name="name">`
+	if got := tpl.Out(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
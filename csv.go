@@ -0,0 +1,50 @@
+package gtpl
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+)
+
+// Parse a row block once for every record of a CSV. With header_as_keys the
+// first record names the columns and each value is assigned under its
+// column's name, otherwise columns are assigned as {col0}, {col1} and so on.
+// Malformed CSV and unknown block names return an error.
+func (tpl *TPL) ParseCSV(block_name string, r io.Reader, header_as_keys bool) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	var header []string
+	if header_as_keys {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		header = record
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for index, value := range record {
+			if index < len(header) {
+				tpl.Assign(header[index], value)
+			} else {
+				tpl.Assign("col"+strconv.Itoa(index), value)
+			}
+		}
+
+		if err := tpl.ParseErr(block_name); err != nil {
+			return err
+		}
+	}
+}
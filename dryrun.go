@@ -0,0 +1,120 @@
+package gtpl
+
+import (
+	"fmt"
+	"sort"
+)
+
+// What parsing a block would do, as found by ParseDryRun()
+type ParseReport struct {
+	// Variables used by the block that have a value
+	Resolved []string
+
+	// Variables used by the block without a value, left as tokens in the output
+	Unresolved []string
+
+	// Handlers called by the block
+	Handlers []string
+
+	// Handlers called by the block that aren't registered
+	MissingHandlers []string
+
+	// The block as it would be rendered
+	Output string
+
+	// Why the block couldn't be rendered, such as ErrBlockNotFound
+	Err error
+}
+
+// Render a block the way Parse() would and report what got substituted,
+// without changing the template. Assignments aren't consumed and the result
+// isn't placed in the parent block. Handlers do run, so handlers with side
+// effects have them.
+func (tpl *TPL) ParseDryRun(block_name string) ParseReport {
+	report := ParseReport{}
+
+	content, ok := tpl.blocks[blockKey(block_name)]
+	if !ok {
+		report.Err = fmt.Errorf("%w: %s", ErrBlockNotFound, block_name)
+		return report
+	}
+
+	dry := tpl.clone()
+	dry.useBlockScoped(block_name)
+	defer dry.snapshotGlobals()()
+
+	variables := make(map[string]bool)
+	for _, match := range compile(`\{([A-Za-z0-9_\-\.]+)(?:\|[^{}]*)?\}`).FindAllStringSubmatch(content, -1) {
+		variables[match[1]] = true
+	}
+	args := argNames(content)
+	for variable := range variables {
+		if _, ok := dry.lookup(variable); ok || args[variable] {
+			report.Resolved = append(report.Resolved, variable)
+		} else {
+			report.Unresolved = append(report.Unresolved, variable)
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, match := range handlerPattern().FindAllStringSubmatchIndex(content, -1) {
+		names[handlerName(content, match)] = true
+	}
+	handlers_mutex.RLock()
+	for name := range names {
+		report.Handlers = append(report.Handlers, name)
+		if _, ok := handlers[name]; !ok {
+			report.MissingHandlers = append(report.MissingHandlers, name)
+		}
+	}
+	handlers_mutex.RUnlock()
+
+	sort.Strings(report.Resolved)
+	sort.Strings(report.Unresolved)
+	sort.Strings(report.Handlers)
+	sort.Strings(report.MissingHandlers)
+
+	if block_name == RootBlock {
+		report.Err = dry.parseRoot()
+		report.Output = dry.output(dry.cleanup(dry.blocks["[_GTPL_ROOT_]"]))
+		return report
+	}
+
+	output, err := dry.renderBlock(block_name)
+	report.Output, report.Err = dry.output(output), err
+	return report
+}
+
+// A copy of the template that can be rendered without changing the original
+func (tpl *TPL) clone() *TPL {
+	dry := *tpl
+	dry.blocks = copyMap(tpl.blocks)
+	dry.LocalAssignments = copyMap(tpl.LocalAssignments)
+	dry.scoped_globals = copyMap(tpl.scoped_globals)
+
+	dry.block_scoped = make(map[string]map[string]string, len(tpl.block_scoped))
+	for block_name, variables := range tpl.block_scoped {
+		dry.block_scoped[block_name] = variables
+	}
+
+	dry.slots = make(map[string][]string, len(tpl.slots))
+	for slot, contents := range tpl.slots {
+		dry.slots[slot] = append([]string(nil), contents...)
+	}
+
+	dry.source_keys = append([]string(nil), tpl.source_keys...)
+	dry.profile = nil
+	return &dry
+}
+
+// A copy of a map of variables, nil stays nil
+func copyMap(variables map[string]string) map[string]string {
+	if variables == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(variables))
+	for variable, value := range variables {
+		copied[variable] = value
+	}
+	return copied
+}
@@ -0,0 +1,65 @@
+package gtpl
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Returned by an Engine asked to render a template that wasn't registered.
+var ErrTemplateNotFound = errors.New("gtpl: template not registered")
+
+// A set of named templates, compiled once at startup and rendered by name for
+// every request. An Engine is safe to use from several goroutines.
+type Engine struct {
+	templates map[string]*Template
+	mutex     sync.RWMutex
+}
+
+// Create an empty Engine
+func NewEngine() *Engine {
+	return &Engine{templates: make(map[string]*Template)}
+}
+
+// Compile a template and register it under name, replacing any template
+// registered under that name before
+func (engine *Engine) Register(name string, source []byte) error {
+	compiled, err := Compile(source)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	engine.templates[name] = compiled
+	return nil
+}
+
+// Render a registered template with data, like Template.Render()
+func (engine *Engine) Render(name string, data map[string]string) (string, error) {
+	compiled, err := engine.Template(name)
+	if err != nil {
+		return "", err
+	}
+	return compiled.Render(data)
+}
+
+// The compiled template registered under name, for rendering with blocks
+// through Template.New()
+func (engine *Engine) Template(name string) (*Template, error) {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+
+	compiled, ok := engine.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+	}
+	return compiled, nil
+}
+
+// The names of every handler its templates can call in alphabetical order,
+// like RegisteredHandlers(). Handlers are registered for the whole package,
+// so every Engine lists the same ones.
+func (engine *Engine) RegisteredHandlers() []string {
+	return RegisteredHandlers()
+}
@@ -0,0 +1,23 @@
+package gtpl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEngineRegisteredHandlers(t *testing.T) {
+	AddHandler("engine_listed", func() string { return "" })
+
+	got := NewEngine().RegisteredHandlers()
+	if !reflect.DeepEqual(got, RegisteredHandlers()) {
+		t.Errorf("got %q, want the same as RegisteredHandlers()", got)
+	}
+
+	found := false
+	for _, name := range got {
+		found = found || name == "engine_listed"
+	}
+	if !found {
+		t.Errorf("engine_listed missing from %q", got)
+	}
+}
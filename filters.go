@@ -0,0 +1,164 @@
+package gtpl
+
+import (
+	"html"
+	"strconv"
+	"strings"
+)
+
+// Filters that can be applied to variables with {name|filter:arg}
+var filters = map[string]func(value string, args []string) string{
+	"safeurl": safeURL,
+	"number":  numberFilter,
+	"ternary": ternaryFilter,
+}
+
+// Replace filtered variable tokens, {name|filter} or {name|filter:arg:arg}
+// with several filters chained by "|". The value is looked up the same way a
+// plain token is, unassigned variables are filtered as an empty string.
+// Tokens naming an unknown filter are left alone. With SetSafeDefault() on,
+// filters get the value unescaped and their result is escaped once.
+func (tpl *TPL) filters(content_results string) string {
+	filter_pattern := compile(`\{([A-Za-z0-9_\-\.]+)((?:\|[A-Za-z0-9_]+(?::[^{}|:]*)*)+)\}`)
+
+	matches := filter_pattern.FindAllStringSubmatchIndex(content_results, -1)
+	if matches == nil {
+		return content_results
+	}
+
+	var results strings.Builder
+	scopes := newArgScopes(content_results)
+	attrs := attrRanges(content_results)
+	last_index := 0
+
+	for _, match := range matches {
+		results.WriteString(content_results[last_index:match[0]])
+		scopes.read(content_results[last_index:match[0]])
+		last_index = match[1]
+
+		value := tpl.filter(content_results[match[0]:match[1]], content_results[match[2]:match[3]], content_results[match[4]:match[5]], scopes)
+		if inRanges(attrs, match[0]) {
+			value = quoteAttr(value)
+		}
+		results.WriteString(value)
+	}
+
+	results.WriteString(content_results[last_index:])
+	return results.String()
+}
+
+// Run the filters of a token on its variable's value, leaving the token as it
+// is when one of them isn't registered
+func (tpl *TPL) filter(token string, variable string, chain string, scopes *argScopes) string {
+	value, ok := scopes.lookup(variable)
+	if !ok {
+		value, _ = tpl.lookup(variable)
+	}
+	value = plainValue(value)
+
+	escaped := false
+	for _, filter := range strings.Split(chain[1:], "|") {
+		args := strings.Split(filter, ":")
+
+		fn, ok := filters[args[0]]
+		if !ok {
+			return token
+		}
+		value = fn(value, args[1:])
+		escaped = escaping_filters[args[0]]
+	}
+
+	// Filters work on plain text, so the result is escaped again like any
+	// assignment unless the last filter escaped it already
+	if safe_default && !escaped {
+		value = html.EscapeString(value)
+	}
+	return sanitize(value)
+}
+
+// Filters whose output is already HTML escaped
+var escaping_filters = map[string]bool{
+	"safeurl": true,
+}
+
+// Neutralize URLs that would run script, javascript:, vbscript: and data:
+// other than raster images, by replacing them with "#". The result is HTML
+// escaped so it can't break out of the attribute it's placed in.
+func safeURL(value string, args []string) string {
+	// Browsers decode entities and ignore control characters and whitespace in schemes
+	scheme := strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, html.UnescapeString(value))
+	scheme = strings.ToLower(scheme)
+
+	switch {
+	case strings.HasPrefix(scheme, "javascript:"), strings.HasPrefix(scheme, "vbscript:"):
+		return "#"
+	case strings.HasPrefix(scheme, "data:") && (!strings.HasPrefix(scheme, "data:image/") || strings.HasPrefix(scheme, "data:image/svg")):
+		return "#"
+	}
+
+	return html.EscapeString(value)
+}
+
+// Format a number with thousands separators, {n|number} keeps the decimals
+// as they are and {n|number:2} rounds to two. Non numbers are left alone.
+func numberFilter(value string, args []string) string {
+	amount, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return value
+	}
+
+	decimals := -1
+	if len(args) > 0 {
+		if parsed, err := strconv.Atoi(args[0]); err == nil {
+			decimals = parsed
+		}
+	}
+
+	return formatNumber(amount, decimals)
+}
+
+// Format a number like 1,234,567.89, decimals of -1 uses as many as needed
+func formatNumber(amount float64, decimals int) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	digits := strconv.FormatFloat(amount, 'f', decimals, 64)
+	fraction := ""
+	if index := strings.IndexByte(digits, '.'); index >= 0 {
+		digits, fraction = digits[:index], digits[index:]
+	}
+
+	var results strings.Builder
+	for index, digit := range digits {
+		if index > 0 && (len(digits)-index)%3 == 0 {
+			results.WriteByte(',')
+		}
+		results.WriteRune(digit)
+	}
+
+	return sign + results.String() + fraction
+}
+
+// Pick between two strings on whether the value is non-empty, so
+// {active|ternary:is-active:} renders "is-active" or nothing
+func ternaryFilter(value string, args []string) string {
+	if value != "" {
+		if len(args) > 0 {
+			return args[0]
+		}
+		return ""
+	}
+
+	if len(args) > 1 {
+		return args[1]
+	}
+	return ""
+}
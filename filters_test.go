@@ -0,0 +1,60 @@
+package gtpl
+
+import (
+	"testing"
+)
+
+func TestSafeURLFilter(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{`javascript:alert(1)`, `#`},
+		{`JavaScript:alert(1)`, `#`},
+		{` javascript:alert(1)`, `#`},
+		{"java\tscript:alert(1)", `#`},
+		{"java\nscript:alert(1)", `#`},
+		{`&#106;avascript:alert(1)`, `#`},
+		{`javascript&colon;alert(1)`, `#`},
+		{`vbscript:msgbox(1)`, `#`},
+		{`data:text/html;base64,PHNjcmlwdD4=`, `#`},
+		{`data:image/svg+xml;base64,PHN2Zz4=`, `#`},
+		{`data:image/png;base64,iVBORw0KGgo=`, `data:image/png;base64,iVBORw0KGgo=`},
+		{`https://example.com/?a=1&b="2"`, `https://example.com/?a=1&amp;b=&#34;2&#34;`},
+		{`/relative/path`, `/relative/path`},
+	}
+
+	for _, test := range tests {
+		tpl, _ := Open([]byte(`<a href="{url|safeurl}">`))
+		tpl.Assign("url", test.url)
+		tpl.Parse(RootBlock)
+
+		want := `<a href="` + test.want + `">`
+		if got := tpl.Out(); got != want {
+			t.Errorf("safeurl(%q) rendered %q, want %q", test.url, got, want)
+		}
+	}
+}
+
+func TestFiltersWithSafeDefault(t *testing.T) {
+	SetSafeDefault(true)
+	defer SetSafeDefault(false)
+
+	var deps map[string]string
+	AddHandlerDeps("safe_default_deps", []string{"u"}, func(values map[string]string) string {
+		deps = values
+		return ""
+	})
+
+	tpl, _ := Open([]byte(`<a href="{u|safeurl}">{u|number}</a><!-- handler: safe_default_deps -->`))
+	tpl.Assign("u", "/x?a=1&b=<2>")
+	tpl.Parse(RootBlock)
+
+	want := `<a href="/x?a=1&amp;b=&lt;2&gt;">/x?a=1&amp;b=&lt;2&gt;</a>`
+	if got := tpl.Out(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if deps["u"] != "/x?a=1&b=<2>" {
+		t.Errorf("deps handler got %q, want %q", deps["u"], "/x?a=1&b=<2>")
+	}
+}
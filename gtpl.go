@@ -1,107 +1,1274 @@
 package gtpl
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Template handler functions that can be called template files
-var handlers = make(map[string]func() string)
+var handlers = make(map[string]handler)
+var handlers_mutex sync.RWMutex
+
+// A registered handler function, exactly one of the functions is set
+type handler struct {
+	fn         func() string
+	fn_bytes   func() []byte
+	fn_context func(tpl *TPL) string
+	fn_deps    func(values map[string]string) string
+	fn_attrs   func(attrs map[string]string) string
+
+	// Variables fn_deps is given
+	deps []string
+
+	// Escape the output instead of inserting it raw
+	sanitized bool
+}
+
+// What a handler directive without a registered handler turns into
+var missing_handler_place_holder = ""
+
+// Called for handler directives without a registered handler, when set
+var default_handler func(name string) string
+
+// Marker that starts every gtpl directive, "<!--" gives "<!-- block: name -->".
+var directive_prefix = "<!--"
+
+// HTML escape values given to Assign() and AssignGlobal()
+var safe_default = false
+
+// Where warnings about templates are written, nothing is logged when nil
+var logger *log.Logger
+var logger_mutex sync.RWMutex
+
+// Alternative delimiters for handler tokens, such as "{{" and "}}". Empty
+// when only the comment syntax is used.
+var handler_open = ""
+var handler_close = ""
+
+// Compiled regular expressions keyed by their expression, so directive
+// patterns built from the prefix are only compiled once.
+var patterns = make(map[string]*regexp.Regexp)
+var patterns_mutex sync.Mutex
+
+// Buffers reused between renders to cut down on garbage
+var buffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// Buffers that grew past this are not put back in the pool
+const max_pooled_buffer = 1 << 20
 
 // Globally assigned variables.
 var globalassignments = make(map[string]string)
+var globals_mutex sync.RWMutex
+
+// Returned when a block name doesn't resolve to a block in the template.
+var ErrBlockNotFound = errors.New("gtpl: block not found")
+
+// Returned by OutErr() when the template's output was already taken.
+var ErrAlreadyRendered = errors.New("gtpl: template was already rendered")
+
+// Returned when blocks or includes nest deeper than the parser allows.
+var ErrMaxDepthExceeded = errors.New("gtpl: maximum nesting depth exceeded")
+
+// How deep blocks may nest inside each other
+const max_block_depth = 64
+
+// How many times handler results may contain more handlers to run
+var max_handler_passes = 1000
+var max_handler_passes_mutex sync.RWMutex
 
 // Simple structure to house our blocks and local assignments.
+//
+// A TPL holds maps, so a copy of one shares its blocks and assignments with
+// the original. Parsing or assigning through either changes both, while some
+// settings don't carry over. Don't copy a TPL after opening it, pass around
+// a *TPL, for example the one from OpenPtr().
 type TPL struct {
 	LocalAssignments map[string]string
 	blocks           map[string]string
+	scoped_globals   map[string]string
+	globals          map[string]string
+	func_assignments map[string]func() string
+	consumed_locals  map[string]string
+	block_scoped     map[string]map[string]string
+	scoped_locals    map[string]string
+	parsed           map[string]bool
+	fallbacks        map[string]string
+	data             map[string]interface{}
+	slots            map[string][]string
+	bound            map[string][]map[string]string
+	profile          *ProfileReport
+	render_depth     int
+	rendered         bool
+	aborted          error
+	warnings         []string
+	source           []byte
+	source_keys      []string
+	mappings         []Mapping
+	random           *rand.Rand
+
+	keep_place_holders bool
+	handlers_disabled  bool
+	source_map         bool
+	minify             bool
+	strip_comments     bool
+	use_default_value  bool
+	default_value      string
+	post_processor     func(string) string
+}
+
+// Open a new template. The template is given as a file name (string), the
+// template content ([]byte) or an io.Reader to read the content from. Several
+// of them, such as a header, body and footer, are joined in order into one
+// template, so block names must be unique across all of them. An empty or
+// whitespace only template opens fine and renders as an empty string,
+// ParseErr() reports ErrBlockNotFound for any block name on it.
+func Open(vArgs ...interface{}) (TPL, error) {
+	name, fbuffer, err := openParams(vArgs)
+	if err != nil {
+		return TPL{}, err
+	}
+
+	return load(nil, name, fbuffer)
+}
+
+// Open a new template like Open(), returning a pointer so the template is
+// never copied by accident
+func OpenPtr(vArgs ...interface{}) (*TPL, error) {
+	tpl, err := Open(vArgs...)
+	if err != nil {
+		return nil, err
+	}
+	return &tpl, nil
+}
+
+// Open a template from a file system such as an embed.FS. Includes in the
+// template are read from the same file system, so a bundle of templates
+// doesn't depend on the working directory. Paths are relative to the root of
+// fsys, SetTemplateDir() doesn't apply, use fs.Sub() to open a sub directory.
+func OpenFS(fsys fs.FS, name string) (TPL, error) {
+	fbuffer, err := readTemplate(fsys, name)
+	if err != nil {
+		return TPL{}, err
+	}
+
+	return load(fsys, name, fbuffer)
+}
+
+// Open a template like Open(), giving up with the context's error once it's
+// cancelled, for templates on slow network storage. Readers stop being read
+// from, a file read that hangs is left behind to finish on its own. Files
+// included by the template are read after the sources and aren't covered.
+func OpenContext(ctx context.Context, vArgs ...interface{}) (TPL, error) {
+	if err := ctx.Err(); err != nil {
+		return TPL{}, err
+	}
+
+	type opened struct {
+		name    string
+		fbuffer []byte
+		err     error
+	}
+	done := make(chan opened, 1)
+
+	go func() {
+		args := make([]interface{}, len(vArgs))
+		for index, arg := range vArgs {
+			if r, ok := arg.(io.Reader); ok {
+				arg = &contextReader{ctx: ctx, r: r}
+			}
+			args[index] = arg
+		}
+
+		name, fbuffer, err := openParams(args)
+		done <- opened{name, fbuffer, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return TPL{}, ctx.Err()
+	case result := <-done:
+		if result.err != nil {
+			return TPL{}, result.err
+		}
+		return load(nil, result.name, result.fbuffer)
+	}
 }
 
-// Open a new template file
-func Open(filename string) (TPL, error) {
-	tpl := TPL{}
+// A reader that stops with the context's error once it's cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (reader *contextReader) Read(p []byte) (int, error) {
+	if err := reader.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return reader.r.Read(p)
+}
 
-	fbuffer, err := ioutil.ReadFile(filename)
+// Open a template from an io.Reader, splitting it into blocks as it's read
+// rather than reading all of it first, for very large templates.
+func OpenReader(r io.Reader) (TPL, error) {
+	return loadStream("io.Reader", r)
+}
 
+// Open a template that must exist, panicking on any error. This mirrors
+// regexp.MustCompile and is meant for templates loaded during init, like
+// ones embedded with embed.FS. It takes the same arguments as Open().
+func MustOpen(vArgs ...interface{}) TPL {
+	tpl, err := Open(vArgs...)
 	if err != nil {
-		return tpl, err
+		panic(err)
+	}
+	return tpl
+}
+
+// Work out the template content from the arguments given to Open(), along
+// with a name to report errors under. Several sources are concatenated in
+// order. Nothing is returned on an error.
+func openParams(vArgs []interface{}) (string, []byte, error) {
+	switch len(vArgs) {
+	case 0:
+		return "", nil, errors.New("gtpl: no template given to open")
+	case 1:
+		return openSource(vArgs[0])
+	}
+
+	names := make([]string, 0, len(vArgs))
+	var content []byte
+
+	for _, arg := range vArgs {
+		name, fbuffer, err := openSource(arg)
+		if err != nil {
+			return "", nil, err
+		}
+		names = append(names, name)
+		content = append(content, fbuffer...)
+	}
+
+	return strings.Join(names, ", "), content, nil
+}
+
+// Read a single template source given to Open()
+func openSource(source interface{}) (string, []byte, error) {
+	switch source := source.(type) {
+	case string:
+		fbuffer, err := readTemplate(nil, source)
+		if err != nil {
+			return "", nil, err
+		}
+		return source, fbuffer, nil
+
+	case []byte:
+		return "[]byte", source, nil
+
+	case io.Reader:
+		fbuffer, err := ioutil.ReadAll(source)
+		if err != nil {
+			return "", nil, err
+		}
+		return "io.Reader", fbuffer, nil
 	}
 
+	return "", nil, fmt.Errorf("gtpl: unsupported type %T given to open, expected a string file name, []byte or io.Reader", source)
+}
+
+// Parse template content into a new TPL
+func load(fsys fs.FS, name string, fbuffer []byte) (tpl TPL, err error) {
+	defer func() { metricsOpened(err) }()
+
 	// Setup the struct
-	tpl.blocks = make(map[string]string)
-	tpl.LocalAssignments = make(map[string]string)
+	tpl.setup()
+	tpl.source = append([]byte(nil), fbuffer...)
+
+	// Editors on Windows like to start UTF-8 files with a byte order mark
+	fbuffer = stripBOM(fbuffer)
+
+	// Without a single directive there are no includes or blocks to look for
+	if !bytes.Contains(fbuffer, []byte(directive_prefix)) {
+		tpl.blocks["[_GTPL_ROOT_]"] = escapeTemplate(string(fbuffer))
+		return tpl, nil
+	}
+
+	// Reject what the sandbox doesn't allow before any file is read
+	if err := sandboxCheck(string(fbuffer)); err != nil {
+		return tpl, fmt.Errorf("gtpl parser failure: %s: %w", name, err)
+	}
+
+	// Catch mistakes while line numbers still match the source, included
+	// files are checked on their own as they're spliced in
+	if err := validate(string(fbuffer)); err != nil {
+		return tpl, fmt.Errorf("gtpl parser failure: %s: %w", name, err)
+	}
+
+	// Splice in included files before any blocks are looked for
+	content, err := include(fsys, string(fbuffer), 0)
+	if err != nil {
+		return tpl, fmt.Errorf("gtpl parser failure: %s: %w", name, err)
+	}
 
 	// Store raw content into output for processing
-	tpl.blocks["[_GTPL_ROOT_]"] = string(fbuffer)
+	tpl.blocks["[_GTPL_ROOT_]"] = normalize(escapeTemplate(content))
 
-	if err := tpl.preprocess(""); err != nil {
-		return tpl, errors.New(fmt.Sprintf("gtpl parser failure: %s: %s", filename, err))
+	if err := tpl.preprocess("", 0); err != nil {
+		return tpl, fmt.Errorf("gtpl parser failure: %s: %w", name, err)
 	}
 
+	tpl.collectWarnings(name)
+
 	return tpl, nil
 }
 
-// Add a new handler
+// Remove a leading UTF-8 byte order mark
+func stripBOM(content []byte) []byte {
+	return bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))
+}
+
+// Note things that are likely mistakes but don't stop the template from
+// rendering, and log them when a logger is set. A name used for both a block
+// and a handler is never ambiguous, blocks are split out when the template is
+// opened, before any handler runs, and <!-- handler: x --> always calls the
+// handler even inside a block named x. It's confusing to read though.
+func (tpl *TPL) collectWarnings(name string) {
+	block_names := make(map[string]bool)
+	handler_names := make(map[string]bool)
+	for block_name, content := range tpl.blocks {
+		if block_name == "[_GTPL_ROOT_]" {
+			continue
+		}
+		block_names[block_name[strings.LastIndex(block_name, ".")+1:]] = true
+		for _, match := range handlerPattern().FindAllStringSubmatchIndex(content, -1) {
+			handler_names[handlerName(content, match)] = true
+		}
+
+		if strings.TrimSpace(content) == "" {
+			tpl.warnings = append(tpl.warnings, fmt.Sprintf("block %s is empty", strings.TrimPrefix(block_name, "[_GTPL_ROOT_].")))
+		}
+	}
+	for _, match := range handlerPattern().FindAllStringSubmatchIndex(tpl.blocks["[_GTPL_ROOT_]"], -1) {
+		handler_names[handlerName(tpl.blocks["[_GTPL_ROOT_]"], match)] = true
+	}
+
+	handlers_mutex.RLock()
+	for handler_name := range handler_names {
+		if _, ok := handlers[handler_name]; !ok {
+			tpl.warnings = append(tpl.warnings, fmt.Sprintf("handler %s is used but not registered yet", handler_name))
+		}
+		if block_names[handler_name] {
+			tpl.warnings = append(tpl.warnings, fmt.Sprintf("%s is used as both a block and a handler name", handler_name))
+		}
+	}
+	handlers_mutex.RUnlock()
+
+	sort.Strings(tpl.warnings)
+
+	if logger := currentLogger(); logger != nil {
+		for _, warning := range tpl.warnings {
+			logger.Printf("gtpl: %s: %s", name, warning)
+		}
+	}
+}
+
+// A copy of the template exactly as it was opened, before includes were
+// spliced in or any block was parsed
+func (tpl *TPL) Source() []byte {
+	return append([]byte(nil), tpl.source...)
+}
+
+// Things noticed when the template was opened that are likely mistakes but
+// don't stop it from rendering, such as empty blocks or handlers that aren't
+// registered yet. A CI job can check that there are none.
+func (tpl *TPL) Warnings() []string {
+	return append([]string(nil), tpl.warnings...)
+}
+
+// Add a new handler. Handler names may only contain letters, digits, '_' and
+// '-', anything else panics since no directive could ever call it. It is safe
+// to add handlers while other goroutines are rendering. The output is trusted
+// and inserted raw, use AddHandlerSanitized() for handlers echoing user input.
 func AddHandler(name string, fn func() string) {
-	handlers[name] = fn
+	registerHandler(name, handler{fn: fn})
+}
+
+// Add a new handler whose output is untrusted. It is HTML escaped and can't
+// contain directives or variable tokens, the same as an assigned value.
+func AddHandlerSanitized(name string, fn func() string) {
+	registerHandler(name, handler{fn: fn, sanitized: true})
+}
+
+// Add a new handler that returns bytes. Handlers producing large output, like
+// a rendered table, skip the conversion to a string this way.
+func AddHandlerBytes(name string, fn func() []byte) {
+	registerHandler(name, handler{fn_bytes: fn})
+}
+
+// Add a new handler that is given the template being rendered, so it can read
+// values stored with SetData() for that render.
+func AddContextHandler(name string, fn func(tpl *TPL) string) {
+	registerHandler(name, handler{fn_context: fn})
+}
+
+// Add a new handler that runs on variables. fn gets the values of the deps
+// variables, unescaped, and only runs when all of them have a value, the
+// directive renders nothing otherwise. Locals count as the values assigned
+// for the block being parsed. The output is trusted like AddHandler() output.
+func AddHandlerDeps(name string, deps []string, fn func(values map[string]string) string) {
+	registerHandler(name, handler{fn_deps: fn, deps: append([]string(nil), deps...)})
+}
+
+// Add a new handler that takes attributes, like a component with props. The
+// directive <!-- handler: button type="primary" label="Save changes" --> calls
+// fn with {"type": "primary", "label": "Save changes"}. Values are double
+// quoted and may hold spaces but no double quotes. Variables in them are
+// substituted before the handler runs and come through unescaped, double
+// quotes included, without ending the attribute. The output is trusted like
+// AddHandler() output.
+func AddAttrHandler(name string, fn func(attrs map[string]string) string) {
+	registerHandler(name, handler{fn_attrs: fn})
+}
+
+// Set what unregistered handlers render as, with %s replaced by the handler
+// name. Something like "[missing handler: %s]" makes registration gaps visible
+// during development. The default is an empty string.
+func SetMissingHandlerPlaceholder(place_holder string) {
+	handlers_mutex.Lock()
+	defer handlers_mutex.Unlock()
+	missing_handler_place_holder = place_holder
+}
+
+// Add a handler that expands a block of the template being rendered, a macro
+// of sorts. With AddBlockHandler("render_nav", "nav") the directive
+// <!-- handler: render_nav --> renders the nav block in its place using the
+// current assignments. Blocks are extracted when a template is opened, before
+// any handler runs, so the block can sit anywhere in the same template. A
+// block that isn't found renders empty, one that keeps expanding itself stops
+// once it's nested as deep as blocks may be.
+func AddBlockHandler(name string, block_name string) {
+	AddContextHandler(name, func(tpl *TPL) string {
+		content, err := tpl.renderBlock(block_name)
+		if err != nil {
+			return ""
+		}
+		return content
+	})
+}
+
+// Call fn with the name of any handler directive that has no registered
+// handler, for example to look handlers up in a registry of your own. Its
+// output is trusted like AddHandler() output and takes the place of the
+// missing handler place holder. Passing nil removes it again.
+func SetDefaultHandler(fn func(name string) string) {
+	handlers_mutex.Lock()
+	defer handlers_mutex.Unlock()
+	default_handler = fn
+}
+
+// The names of every registered handler in alphabetical order, for checking
+// why a handler directive renders nothing
+func RegisteredHandlers() []string {
+	handlers_mutex.RLock()
+	defer handlers_mutex.RUnlock()
+
+	names := make([]string, 0, len(handlers))
+	for name := range handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Store a handler, panicking on names a handler directive could never match
+func registerHandler(name string, h handler) {
+	if !compile(`^[A-Za-z0-9_-]+$`).MatchString(name) {
+		panic(fmt.Sprintf("gtpl: invalid handler name %q, only letters, digits, '_' and '-' are allowed", name))
+	}
+
+	handlers_mutex.Lock()
+	defer handlers_mutex.Unlock()
+	handlers[name] = h
+}
+
+// HTML escape every value given to Assign(), AssignGlobal() and the Assign
+// functions built on them, leaving AssignRaw() for trusted HTML. This is off
+// by default so existing templates keep working, and is meant to become the
+// default in the next major version. Set it once at startup.
+func SetSafeDefault(enabled bool) {
+	safe_default = enabled
+}
+
+// Write warnings about templates, such as a name used for both a block and a
+// handler, to the given logger. Nothing is logged by default.
+func SetLogger(l *log.Logger) {
+	logger_mutex.Lock()
+	defer logger_mutex.Unlock()
+	logger = l
+}
+
+// The logger set with SetLogger(), nil when there isn't one
+func currentLogger() *log.Logger {
+	logger_mutex.RLock()
+	defer logger_mutex.RUnlock()
+	return logger
+}
+
+// Change the marker that starts gtpl directives. With "<!--gtpl:" blocks are
+// written as "<!--gtpl: block: name -->" and plain HTML comments are left
+// alone by the value sanitizer. Call this before opening or assigning anything.
+func SetDirectivePrefix(prefix string) {
+	if prefix == "" {
+		panic("gtpl: directive prefix must not be empty")
+	}
+	directive_prefix = prefix
+}
+
+// Limit how many times handler output may contain more handler directives to
+// run, 1000 by default. A render going past it, usually because a handler
+// outputs its own directive, stops with ErrMaxDepthExceeded from ParseErr(),
+// OutErr() and OutToContext().
+func SetMaxHandlerExpansions(passes int) {
+	max_handler_passes_mutex.Lock()
+	defer max_handler_passes_mutex.Unlock()
+	max_handler_passes = passes
 }
 
-// Assign a new global variable's value
+// The limit set with SetMaxHandlerExpansions()
+func maxHandlerPasses() int {
+	max_handler_passes_mutex.RLock()
+	defer max_handler_passes_mutex.RUnlock()
+	return max_handler_passes
+}
+
+// Also accept handlers written with other delimiters, SetHandlerSyntax("{{", "}}")
+// makes "{{name}}" call the same handler as "<!-- handler: name -->". The
+// comment syntax keeps working, which eases migrating templates from other
+// engines. Passing two empty strings turns the alternative syntax off again.
+// Like SetDirectivePrefix(), call this before opening or assigning anything,
+// it isn't safe to change while templates are rendered.
+func SetHandlerSyntax(open string, close string) {
+	if (open == "") != (close == "") {
+		panic("gtpl: handler syntax needs both an open and a close delimiter")
+	}
+	handler_open = open
+	handler_close = close
+}
+
+// Assign a new global variable's value. Globals live in a package-level map
+// that is never cleared, so a server assigning per-request globals keeps every
+// one of them around and leaks them into later renders. Use WithScopedGlobals()
+// for anything that belongs to a single render.
 func (tpl *TPL) AssignGlobal(variable string, value string) {
-	globalassignments[variable] = sanitize(value)
+	if tpl.scoped_globals != nil {
+		tpl.scoped_globals[variable] = assignable(value)
+		return
+	}
+	globals_mutex.Lock()
+	globalassignments[variable] = assignable(value)
+	globals_mutex.Unlock()
+}
+
+// Replace every package global at once. Renders see either the old set or
+// the new one, never a mix, so values that belong together such as a base
+// URL and an asset host can be changed while pages are being rendered. The
+// values are sanitized like AssignGlobal() values.
+func ReplaceGlobals(vars map[string]string) {
+	replaced := make(map[string]string, len(vars))
+	for variable, value := range vars {
+		replaced[variable] = assignable(value)
+	}
+
+	globals_mutex.Lock()
+	globalassignments = replaced
+	globals_mutex.Unlock()
+}
+
+// Keep globals assigned on this template to this template. They still apply
+// to every block like normal globals, take precedence over package globals,
+// and are discarded once Out() has been called.
+func (tpl *TPL) WithScopedGlobals() {
+	if tpl.scoped_globals == nil {
+		tpl.scoped_globals = make(map[string]string)
+	}
 }
 
 // Assign a new local variable's value
 func (tpl *TPL) Assign(variable string, value string) {
+	tpl.setup()
+	tpl.LocalAssignments[variable] = assignable(value)
+}
+
+// Assign a local variable with runs of whitespace, newlines included,
+// collapsed to a single space and the ends trimmed, for single line fields
+// such as titles taken from user input
+func (tpl *TPL) AssignNormalized(variable string, value string) {
+	tpl.Assign(variable, strings.Join(strings.Fields(value), " "))
+}
+
+// Assign a local variable that only applies when block_name is parsed, so two
+// blocks can each be given their own {name} before either is parsed. It's
+// consumed by that parse like any local and takes precedence over globals and
+// locals assigned with Assign(). A local of the same name is left for the next
+// parse instead of being consumed.
+func (tpl *TPL) AssignIn(block_name string, variable string, value string) {
+	if tpl.block_scoped == nil {
+		tpl.block_scoped = make(map[string]map[string]string)
+	}
+	if tpl.block_scoped[block_name] == nil {
+		tpl.block_scoped[block_name] = make(map[string]string)
+	}
+	tpl.block_scoped[block_name][variable] = assignable(value)
+}
+
+// Make the variables assigned to a block with AssignIn() the layer its parse
+// checks first
+func (tpl *TPL) useBlockScoped(block_name string) {
+	tpl.scoped_locals = tpl.block_scoped[block_name]
+	delete(tpl.block_scoped, block_name)
+}
+
+// Assign a local variable unless the variable already has a value, so a base
+// layer can provide defaults that a more specific layer sets first with
+// Assign(). Locals, function variables, scoped globals and package globals
+// all count, since any of them would fill the token already.
+func (tpl *TPL) AssignDefault(variable string, value string) {
+	tpl.setup()
+	if _, ok := tpl.LocalAssignments[variable]; ok {
+		return
+	}
+	if _, ok := tpl.func_assignments[variable]; ok {
+		return
+	}
+	if _, ok := tpl.scoped_globals[variable]; ok {
+		return
+	}
+
+	globals_mutex.RLock()
+	_, ok := globalassignments[variable]
+	globals_mutex.RUnlock()
+	if ok {
+		return
+	}
+
+	tpl.Assign(variable, value)
+}
+
+// Assign a local variable only when validate accepts the value. The
+// validator's error is returned as is and nothing is assigned when it fails.
+func (tpl *TPL) AssignValidated(variable string, value string, validate func(string) error) error {
+	if err := validate(value); err != nil {
+		return err
+	}
+	tpl.Assign(variable, value)
+	return nil
+}
+
+// Assign a local variable's value that is trusted HTML. It's never HTML
+// escaped, even with SetSafeDefault(true), but is still sanitized so it can't
+// inject directives or variable tokens.
+func (tpl *TPL) AssignRaw(variable string, value string) {
+	tpl.setup()
 	tpl.LocalAssignments[variable] = sanitize(value)
 }
 
+// The sanitized form of an assigned value, HTML escaped when safe_default is set
+func assignable(value string) string {
+	if safe_default {
+		value = html.EscapeString(value)
+	}
+	return sanitize(value)
+}
+
+// An assigned value as it was before assignable() escaped it, for filters and
+// handlers that work on the plain text
+func plainValue(value string) string {
+	value = desanitize(value)
+	if safe_default {
+		value = html.UnescapeString(value)
+	}
+	return value
+}
+
+// Assign a local variable from any value. template.HTML and template.JS are
+// taken as trusted and assigned raw, bypassing the sanitizer, so they can't
+// come from user input. []byte is used as text, fmt.Stringer values use their
+// String() method and anything else is formatted with %v. A nil value or nil
+// pointer assigns an empty string rather than "<nil>", other pointers are
+// followed to the value they point at unless they implement fmt.Stringer.
+func (tpl *TPL) AssignAny(variable string, value interface{}) {
+	if value == nil {
+		tpl.Assign(variable, "")
+		return
+	}
+
+	if pointer := reflect.ValueOf(value); pointer.Kind() == reflect.Ptr {
+		if pointer.IsNil() {
+			tpl.Assign(variable, "")
+			return
+		}
+		if _, ok := value.(fmt.Stringer); !ok {
+			tpl.AssignAny(variable, pointer.Elem().Interface())
+			return
+		}
+	}
+
+	switch value := value.(type) {
+	case template.HTML:
+		tpl.setup()
+		tpl.LocalAssignments[variable] = string(value)
+	case template.JS:
+		tpl.setup()
+		tpl.LocalAssignments[variable] = string(value)
+	case string:
+		tpl.Assign(variable, value)
+	case []byte:
+		tpl.Assign(variable, string(value))
+	case fmt.Stringer:
+		tpl.Assign(variable, value.String())
+	default:
+		tpl.Assign(variable, fmt.Sprintf("%v", value))
+	}
+}
+
+// Assign an amount of money with thousands separators and two decimals. A
+// three letter code follows the amount, "1,234.50 EUR", anything else is used
+// as a symbol in front of it, "$1,234.50".
+func (tpl *TPL) AssignMoney(variable string, amount float64, currency string) {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	if compile(`^[A-Z]{3}$`).MatchString(currency) {
+		tpl.Assign(variable, sign+formatNumber(amount, 2)+" "+currency)
+		return
+	}
+	tpl.Assign(variable, sign+currency+formatNumber(amount, 2))
+}
+
+// Append to a local variable instead of replacing its value, so a single
+// {items} can be built up over several iterations. Without a prior value this
+// is the same as Assign().
+func (tpl *TPL) AppendAssign(variable string, value string) {
+	tpl.setup()
+	tpl.LocalAssignments[variable] += assignable(value)
+}
+
+// Assign a function whose result replaces the variable. Unlike a normal
+// assignment the function is called again for every single occurrence, each
+// getting a fresh value, which suits tokens like {csrf_token} that must differ
+// per form on a page. Results are escaped like Assign() values. The function
+// stays assigned for every following parse.
+func (tpl *TPL) AssignFunc(variable string, fn func() string) {
+	if tpl.func_assignments == nil {
+		tpl.func_assignments = make(map[string]func() string)
+	}
+	tpl.func_assignments[variable] = fn
+}
+
+// Add content to a named slot. Every <!-- slot: name --> directive renders all
+// content pushed to that slot, in order, when Out() is called. This lets
+// handlers contribute to shared regions, like a script tag for the <head>.
+// The content is inserted as is, the same as handler output.
+func (tpl *TPL) PushSlot(name string, content string) {
+	if tpl.slots == nil {
+		tpl.slots = make(map[string][]string)
+	}
+	tpl.slots[name] = append(tpl.slots[name], content)
+}
+
+// Replace slot directives with the content pushed to them
+func (tpl *TPL) fillSlots(content_results string) string {
+	slot_pattern := compile(regexp.QuoteMeta(directive_prefix) + `\s*slot\s*:\s*([A-Za-z0-9_-]+)\s*-->`)
+
+	return slot_pattern.ReplaceAllStringFunc(content_results, func(directive string) string {
+		name := slot_pattern.FindStringSubmatch(directive)[1]
+		return strings.Join(tpl.slots[name], "")
+	})
+}
+
+// Store an arbitrary value on the template for context handlers to read
+func (tpl *TPL) SetData(key string, value interface{}) {
+	if tpl.data == nil {
+		tpl.data = make(map[string]interface{})
+	}
+	tpl.data[key] = value
+}
+
+// Read a value stored with SetData(), nil when there is none
+func (tpl *TPL) Data(key string) interface{} {
+	return tpl.data[key]
+}
+
+// Assign a time formatted with a Go layout. A zero time assigns an empty
+// string so the field can be left out.
+func (tpl *TPL) AssignTime(variable string, t time.Time, layout string) {
+	if t.IsZero() {
+		tpl.Assign(variable, "")
+		return
+	}
+	tpl.Assign(variable, t.Format(layout))
+}
+
+// Assign every key of url.Values, such as a submitted form, as a local
+// variable. Keys with several values only assign their first value.
+func (tpl *TPL) AssignValues(v url.Values) {
+	for variable := range v {
+		tpl.Assign(variable, v.Get(variable))
+	}
+}
+
+// Assign every environment variable starting with prefix as a local variable
+// named after the rest of its name, lowercased. With the prefix "APP_",
+// APP_DB_HOST is assigned to {db_host}. Lowercasing matches the usual style of
+// template variables, so rename a variable in the environment rather than
+// the template when two only differ in case.
+func (tpl *TPL) AssignEnv(prefix string) {
+	for _, entry := range os.Environ() {
+		index := strings.IndexByte(entry, '=')
+		if index < 0 || index == len(prefix) || !strings.HasPrefix(entry[:index], prefix) {
+			continue
+		}
+		tpl.Assign(strings.ToLower(entry[len(prefix):index]), entry[index+1:])
+	}
+}
+
+// Assign every entry of vars as a local variable
+func (tpl *TPL) AssignMany(vars map[string]string) {
+	for variable, value := range vars {
+		tpl.Assign(variable, value)
+	}
+}
+
+// Assign nested data as local variables with dotted names. A nested map makes
+// {address.city} available and slice elements are indexed as {items.0},
+// {items.1}. Leaf values are formatted with %v.
+func (tpl *TPL) AssignMap(data map[string]interface{}) {
+	for key, value := range data {
+		tpl.assignFlattened(key, value)
+	}
+}
+
+// Assign a value under a dotted name, descending into maps and slices
+func (tpl *TPL) assignFlattened(variable string, value interface{}) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			tpl.assignFlattened(variable+"."+key, item)
+		}
+	case map[string]string:
+		for key, item := range value {
+			tpl.Assign(variable+"."+key, item)
+		}
+	case []interface{}:
+		for index, item := range value {
+			tpl.assignFlattened(variable+"."+strconv.Itoa(index), item)
+		}
+	case []map[string]interface{}:
+		for index, item := range value {
+			tpl.assignFlattened(variable+"."+strconv.Itoa(index), item)
+		}
+	case []string:
+		for index, item := range value {
+			tpl.Assign(variable+"."+strconv.Itoa(index), item)
+		}
+	default:
+		tpl.Assign(variable, fmt.Sprintf("%v", value))
+	}
+}
+
 // Parse a block. Blocks of code need to be parsed from most inner, to outter.
+// Parsing RootBlock renders the content outside of blocks in place.
 func (tpl *TPL) Parse(block_name string) {
+	tpl.ParseErr(block_name)
+}
+
+// Assign vars and parse a block in one call, for filling in a row per loop
+// iteration. The variables are consumed by the block like any locals.
+func (tpl *TPL) ParseWith(block_name string, vars map[string]string) {
+	tpl.AssignMany(vars)
+	tpl.Parse(block_name)
+}
+
+// Keep rows of variables for the block of the same name, to be parsed once per
+// row by ParseBound(). Assigning again replaces the rows.
+func (tpl *TPL) AssignSlice(block_name string, rows []map[string]string) {
+	if tpl.bound == nil {
+		tpl.bound = make(map[string][]map[string]string)
+	}
+	tpl.bound[block_name] = rows
+}
+
+// Parse a block once for every row given to AssignSlice() under its name, with
+// the row's keys assigned as locals, like calling ParseWith() in a loop. The
+// rows are used up. A block without rows isn't parsed, so a fallback set with
+// SetBlockFallback() shows instead.
+func (tpl *TPL) ParseBound(block_name string) error {
+	if _, ok := tpl.blocks[blockKey(block_name)]; !ok {
+		return fmt.Errorf("%w: %s", ErrBlockNotFound, block_name)
+	}
+
+	rows := tpl.bound[block_name]
+	delete(tpl.bound, block_name)
+
+	for _, row := range rows {
+		tpl.AssignMany(row)
+		if err := tpl.ParseErr(block_name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parse a block like Parse(), but report block names that don't resolve.
+func (tpl *TPL) ParseErr(block_name string) error {
+	_, err := tpl.parse(block_name)
+	return err
+}
+
+// Parse a block like Parse() and return the text it added to the document,
+// rendered the way Out() would render it. Child blocks that haven't been
+// parsed yet are left out. An empty string is returned if the block couldn't
+// be parsed.
+func (tpl *TPL) ParseReturn(block_name string) string {
+	content_results, err := tpl.parse(block_name)
+	if err != nil {
+		return ""
+	}
+	return tpl.output(tpl.cleanup(content_results))
+}
+
+// Parse a block into its parent and return the sanitized content spliced in,
+// without the block's own place holder
+func (tpl *TPL) parse(block_name string) (string, error) {
+	if tpl.aborted != nil {
+		return "", tpl.aborted
+	}
+
+	if block_name == RootBlock {
+		err := tpl.parseRoot()
+		return tpl.blocks["[_GTPL_ROOT_]"], err
+	}
+
 	// Add the root block
 	block_name = "[_GTPL_ROOT_]." + block_name
 
+	if _, ok := tpl.blocks[block_name]; !ok {
+		return "", fmt.Errorf("%w: %s", ErrBlockNotFound, strings.TrimPrefix(block_name, "[_GTPL_ROOT_]."))
+	}
+
+	defer tpl.profileBlock(strings.TrimPrefix(block_name, "[_GTPL_ROOT_]."), time.Now())
+	defer tpl.snapshotGlobals()()
+
+	tpl.useBlockScoped(strings.TrimPrefix(block_name, "[_GTPL_ROOT_]."))
+
 	// Cut off the last block name to get the parent block name
 	cut_index := strings.LastIndex(block_name, ".")
 	parent_block_name := block_name[:cut_index]
 
-	// Store raw content
-	content_results := tpl.blocks[block_name] + parent_block_name
+	// Store raw content, followed by the block's own place holder so it can be parsed again
+	content_results := tpl.blocks[block_name] + placeHolder(block_name)
 
 	content_results = tpl.assignments(content_results)
 
 	// Run handlers
 	content_results = tpl.handlers(content_results)
+	if tpl.aborted != nil {
+		return "", tpl.aborted
+	}
 
 	// Update the block in the map
-	tpl.blocks[parent_block_name] = strings.Replace(tpl.blocks[parent_block_name], parent_block_name, content_results, 1)
+	tpl.blocks[parent_block_name] = strings.Replace(tpl.blocks[parent_block_name], placeHolder(block_name), tpl.markSource(block_name, content_results), 1)
+	tpl.markParsed(block_name)
+
+	return strings.TrimSuffix(content_results, placeHolder(block_name)), nil
 }
 
 // Provide output from the most parent blocks
 func (tpl *TPL) Out() string {
-	// Prepwork for cleanup
-	place_holder_pattern := regexp.MustCompile(regexp.QuoteMeta("[_GTPL_ROOT_].") + "[A-Za-z0-9_\\-\\.]+")
+	tpl.setup()
+	defer tpl.profileOut(time.Now())
+	defer metricsRendered(time.Now())
+	defer tpl.snapshotGlobals()()
+
+	tpl.blocks["[_GTPL_ROOT_]"] = tpl.finalize()
+
+	// Scoped globals only last for one render
+	if tpl.scoped_globals != nil {
+		tpl.scoped_globals = make(map[string]string)
+	}
+
+	tpl.rendered = true
+
+	content, mappings := tpl.outputMapped(tpl.blocks["[_GTPL_ROOT_]"])
+	tpl.mappings = mappings
+	return content
+}
+
+// Provide output like Out(), but fail with ErrAlreadyRendered when Out() was
+// called before. Out() consumes the template, so a second call doesn't give
+// the document that was rendered the first time.
+func (tpl *TPL) OutErr() (string, error) {
+	if tpl.rendered {
+		return "", ErrAlreadyRendered
+	}
+	if tpl.aborted != nil {
+		return "", tpl.aborted
+	}
+
+	content := tpl.Out()
+	if tpl.aborted != nil {
+		return "", tpl.aborted
+	}
+	return content, nil
+}
+
+// Stop rendering, for a context handler that finds the page shouldn't be
+// rendered after all, for example because the request has to be redirected.
+// No more handlers run, and ParseErr(), OutErr() and OutToContext() return
+// err instead of output from then on. Only the first abort is kept.
+func (tpl *TPL) Abort(err error) {
+	if tpl.aborted == nil {
+		tpl.aborted = err
+	}
+}
+
+// How much output OutToContext() writes between checks of its context
+const write_chunk_size = 32 * 1024
+
+// Write the output of Out() to w in chunks, stopping with the context's error
+// once it's cancelled, so a slow client can't hold a render open forever.
+// Writers with a SetWriteDeadline method, such as a net.Conn, also get the
+// context's deadline set so a single stuck write is cut off too.
+func (tpl *TPL) OutToContext(ctx context.Context, w io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if conn, ok := w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+			if err := conn.SetWriteDeadline(deadline); err != nil {
+				return err
+			}
+		}
+	}
+
+	content := tpl.Out()
+	if tpl.aborted != nil {
+		return tpl.aborted
+	}
+
+	for len(content) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		chunk := content
+		if len(chunk) > write_chunk_size {
+			chunk = chunk[:write_chunk_size]
+		}
+		if _, err := io.WriteString(w, chunk); err != nil {
+			return err
+		}
+		content = content[len(chunk):]
+	}
+
+	return nil
+}
+
+// Render once and write the output of Out() to every writer, for example to
+// the response and a cache file at the same time. Writing stops at the first
+// writer that fails.
+func (tpl *TPL) OutToAll(writers ...io.Writer) error {
+	content := tpl.Out()
+	if tpl.aborted != nil {
+		return tpl.aborted
+	}
+
+	_, err := io.WriteString(io.MultiWriter(writers...), content)
+	return err
+}
+
+// Provide the same output as Out() through a reader. The root block is left
+// as it was, so the template can still be parsed further afterwards.
+func (tpl *TPL) OutReader() io.Reader {
+	defer metricsRendered(time.Now())
+	defer tpl.snapshotGlobals()()
+	content, mappings := tpl.outputMapped(tpl.finalize())
+	tpl.mappings = mappings
+	return strings.NewReader(content)
+}
+
+// Run handlers over the root block and clean it up, without storing the result
+func (tpl *TPL) finalize() string {
+	// Conditionals outside of blocks are resolved even when the root isn't parsed
+	content_results := tpl.conditionals(tpl.blocks["[_GTPL_ROOT_]"])
 
 	// Run handlers
-	tpl.blocks["[_GTPL_ROOT_]"] = tpl.handlers(tpl.blocks["[_GTPL_ROOT_]"])
+	content_results = tpl.handlers(content_results)
+
+	// Handlers are done pushing, fill the slots
+	content_results = tpl.fillSlots(content_results)
+
+	// Remove place holders and clean up whitespace
+	return tpl.cleanup(content_results)
+}
+
+// Report whether {name}, a filtered {name|filter} or <!-- if: name -->
+// appears anywhere in the template's blocks, so costly values can be skipped
+// when nothing uses them. Escaped {\name} tokens and tokens that were already
+// substituted don't count.
+func (tpl *TPL) UsesVariable(name string) bool {
+	if_pattern := compile(regexp.QuoteMeta(directive_prefix) + `\s*if\s*:\s*([A-Za-z0-9_\-\.]+)\s*-->`)
+
+	for _, content := range tpl.blocks {
+		if strings.Contains(content, "{"+name+"}") || strings.Contains(content, "{"+name+"|") {
+			return true
+		}
+		for _, match := range if_pattern.FindAllStringSubmatch(content, -1) {
+			if match[1] == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Leave the place holders of blocks that were never parsed in the output as
+// "[_GTPL_ROOT_].blockname" markers. This is for debugging, it shows whether a
+// block is missing because it rendered empty or because it was never parsed.
+func (tpl *TPL) SetKeepPlaceholders(keep bool) {
+	tpl.keep_place_holders = keep
+}
+
+// Render every variable token that is still unassigned when the output is
+// produced as value, instead of leaving the raw {name} in place. Escaped
+// tokens are left alone. Note that anything shaped like a token counts, a
+// {name} inside inline CSS or Javascript included.
+func (tpl *TPL) SetDefaultValue(value string) {
+	tpl.use_default_value = true
+	tpl.default_value = sanitize(value)
+}
+
+// Minify the output by removing HTML comments and collapsing whitespace runs,
+// between tags too, to a single space. Conditional comments and the content of
+// pre, textarea, script and style elements are left alone.
+func (tpl *TPL) SetMinify(enabled bool) {
+	tpl.minify = enabled
+}
+
+// Replace the final whitespace cleanup with a function of your own, for
+// output formats where dropping blank lines is wrong, such as JSON or emails
+// that need CRLF line endings. The function gets the finished output and
+// returns what Out() gives back. Passing nil restores the built-in cleanup.
+func (tpl *TPL) SetPostProcessor(fn func(string) string) {
+	tpl.post_processor = fn
+}
 
-	// Remove all the position place holders
-	tpl.blocks["[_GTPL_ROOT_]"] = string(place_holder_pattern.ReplaceAll([]byte(tpl.blocks["[_GTPL_ROOT_]"]), []byte("")))
+// Turn handler processing on or off, it's on by default. With it off no
+// handler is called by Parse(), Out() or anything else rendering this
+// template, handler directives stay in the output as they were written. Use
+// this for untrusted template content that must not run registered handlers.
+func (tpl *TPL) SetHandlersEnabled(enabled bool) {
+	tpl.handlers_disabled = !enabled
+}
+
+// Remove HTML comments, such as notes left for other developers, from the
+// output without minifying it. Directives are gone by then, so every other
+// comment goes, including ones from assigned values, except conditional
+// comments and comments inside pre, textarea, script and style elements.
+func (tpl *TPL) SetStripComments(enabled bool) {
+	tpl.strip_comments = enabled
+}
+
+// Show content in place of a block that never gets parsed, such as a "no
+// results" message for a row block, instead of leaving nothing. The content
+// is trusted template text and isn't processed any further.
+func (tpl *TPL) SetBlockFallback(block_name string, content string) {
+	if tpl.fallbacks == nil {
+		tpl.fallbacks = make(map[string]string)
+	}
+	tpl.fallbacks[blockKey(block_name)] = content
+}
+
+// Remember that a block was parsed, so its fallback isn't shown
+func (tpl *TPL) markParsed(key string) {
+	if tpl.parsed == nil {
+		tpl.parsed = make(map[string]bool)
+	}
+	tpl.parsed[key] = true
+}
+
+// Render a single block with the current assignments and return just that
+// fragment, leaving the rest of the document untouched. Local assignments
+// are consumed the same way Parse() consumes them.
+func (tpl *TPL) RenderBlock(block_name string) (string, error) {
+	content_results, err := tpl.renderBlock(block_name)
+	if err != nil {
+		return "", err
+	}
+
+	return tpl.output(content_results), nil
+}
+
+// Render a block like RenderBlock(), but keep the result sanitized so it can
+// be spliced into other content
+func (tpl *TPL) renderBlock(block_name string) (string, error) {
+	key := blockKey(block_name)
+
+	content_results, ok := tpl.blocks[key]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrBlockNotFound, block_name)
+	}
+
+	// Blocks rendered by handlers could end up rendering themselves
+	if tpl.render_depth >= max_block_depth {
+		return "", fmt.Errorf("%w: blocks rendered more than %d deep at %s", ErrMaxDepthExceeded, max_block_depth, block_name)
+	}
+	tpl.render_depth++
+	defer func() { tpl.render_depth-- }()
+	defer tpl.snapshotGlobals()()
+
+	tpl.useBlockScoped(block_name)
 
-	// Clean up random whitespacing
-	re := regexp.MustCompile(`(?m)^\s*$[\r\n]*|[\r\n]+\s+\z`)
-	tpl.blocks["[_GTPL_ROOT_]"] = re.ReplaceAllString(tpl.blocks["[_GTPL_ROOT_]"], "")
+	content_results = tpl.assignments(content_results)
+	content_results = tpl.handlers(content_results)
+
+	return tpl.cleanup(content_results), nil
+}
 
-	return desanitize(tpl.blocks["[_GTPL_ROOT_]"])
+// Create the maps, a zero TPL then behaves like an empty template
+func (tpl *TPL) setup() {
+	if tpl.blocks == nil {
+		tpl.blocks = make(map[string]string)
+	}
+	if tpl.LocalAssignments == nil {
+		tpl.LocalAssignments = make(map[string]string)
+	}
 }
 
 // Preprocesses the entire tree of blocks
-func (tpl *TPL) preprocess(parent_block_name string) error {
+func (tpl *TPL) preprocess(parent_block_name string, depth int) error {
 	// Begin processing the blocks
-	begin_pattern := regexp.MustCompile("<!-- block: ([A-Za-z0-9_-]+) -->")
+	begin_pattern := compile(regexp.QuoteMeta(directive_prefix) + " block: ([A-Za-z0-9_-]+) -->")
 	var raw_block_name []string
 
 	// Replace the block with placeholders
@@ -110,6 +1277,11 @@ func (tpl *TPL) preprocess(parent_block_name string) error {
 		parent_block_name = "[_GTPL_ROOT_]"
 	}
 
+	// Most blocks hold no other blocks, skip the pattern for those
+	if !strings.Contains(tpl.blocks[parent_block_name], directive_prefix+" block: ") {
+		return nil
+	}
+
 	raw_block_name = begin_pattern.FindStringSubmatch(tpl.blocks[parent_block_name])
 
 	// No blocks found
@@ -117,28 +1289,37 @@ func (tpl *TPL) preprocess(parent_block_name string) error {
 		return nil
 	}
 
+	if depth >= max_block_depth {
+		return fmt.Errorf("%w: blocks nested more than %d deep at %s", ErrMaxDepthExceeded, max_block_depth, strings.TrimPrefix(parent_block_name, "[_GTPL_ROOT_]."))
+	}
+
 	for raw_block_name != nil {
+		open_tag := directive_prefix + " block: " + raw_block_name[1] + " -->"
+		close_tag := directive_prefix + " /block: " + raw_block_name[1] + " -->"
 
 		// Get the block's content
-		block_pattern := regexp.MustCompile("<!-- block: " + raw_block_name[1] + " -->(?ms:(.*?))<!-- /block: " + raw_block_name[1] + " -->")
-		block_content := block_pattern.FindStringSubmatch(tpl.blocks[parent_block_name])
+		block_content, found := blockContent(tpl.blocks[parent_block_name], open_tag, close_tag)
 
 		// No match was found, throw an error!
-		if block_content == nil {
+		if !found {
 			return errors.New("Failed to find a match for block: " + raw_block_name[1])
 		}
 
 		// active block name
 		active_block_name := parent_block_name + "." + raw_block_name[1]
 
-		// Store found new block in the hashtable
-		tpl.blocks[active_block_name] = block_content[1]
+		// Store found new block in the hashtable, along with the arguments of
+		// the includes it's in
+		open_index := strings.Index(tpl.blocks[parent_block_name], open_tag)
+		tpl.blocks[active_block_name] = wrapArgs(tpl.blocks[parent_block_name], open_index, block_content)
 
 		// Tokenize the newly stored block as a reference in the parent
-		tpl.blocks[parent_block_name] = string(block_pattern.ReplaceAll([]byte(tpl.blocks[parent_block_name]), []byte(active_block_name)))
+		tpl.blocks[parent_block_name] = replaceBlocks(tpl.blocks[parent_block_name], open_tag, close_tag, placeHolder(active_block_name))
 
 		// parse sub blocks
-		tpl.preprocess(active_block_name)
+		if err := tpl.preprocess(active_block_name, depth+1); err != nil {
+			return err
+		}
 
 		// Next search
 		raw_block_name = begin_pattern.FindStringSubmatch(tpl.blocks[parent_block_name])
@@ -147,55 +1328,582 @@ func (tpl *TPL) preprocess(parent_block_name string) error {
 	return nil
 }
 
-// Replace variable tokens with values
+// Find the content between the first open tag and the closest close tag after it
+func blockContent(content string, open_tag string, close_tag string) (string, bool) {
+	open_index := strings.Index(content, open_tag)
+	if open_index < 0 {
+		return "", false
+	}
+	content = content[open_index+len(open_tag):]
+
+	close_index := strings.Index(content, close_tag)
+	if close_index < 0 {
+		return "", false
+	}
+	return content[:close_index], true
+}
+
+// Replace every open tag through its closest close tag with a place holder
+func replaceBlocks(content string, open_tag string, close_tag string, place_holder string) string {
+	var results strings.Builder
+
+	for {
+		open_index := strings.Index(content, open_tag)
+		if open_index < 0 {
+			break
+		}
+
+		close_index := strings.Index(content[open_index+len(open_tag):], close_tag)
+		if close_index < 0 {
+			break
+		}
+		close_index += open_index + len(open_tag)
+
+		results.WriteString(content[:open_index])
+		results.WriteString(place_holder)
+		content = content[close_index+len(close_tag):]
+	}
+
+	results.WriteString(content)
+	return results.String()
+}
+
+// Matches block and handler directives with any spacing. The groups are the
+// leading trim marker, the closing slash, the keyword, the name and the
+// trailing trim marker.
+func directivePattern() *regexp.Regexp {
+	return compile(regexp.QuoteMeta(directive_prefix) + `\s*(-\s*)?(/?)\s*(block|handler)\s*:\s*([A-Za-z0-9_-]+)(\s+-)?\s*-->`)
+}
+
+// Rewrite directives with loose spacing such as "<!--block:foo-->" into their
+// canonical "<!-- block: foo -->" form so block scanning can match them exactly.
+// A "-" right after the prefix trims the whitespace before the directive, a
+// " -" right before the "-->" trims the whitespace after it.
+func normalize(content string) string {
+	directive_pattern := directivePattern()
+
+	var results strings.Builder
+	last_index := 0
+
+	for _, match := range directive_pattern.FindAllStringSubmatchIndex(content, -1) {
+		// Text between the previous directive and this one
+		text := content[last_index:match[0]]
+		if match[2] >= 0 {
+			text = strings.TrimRight(text, " \t\r\n")
+		}
+		results.WriteString(text)
+
+		results.WriteString(directive_prefix + " " + content[match[4]:match[5]] + content[match[6]:match[7]] + ": " + content[match[8]:match[9]] + " -->")
+
+		last_index = match[1]
+		if match[10] >= 0 {
+			last_index += len(content[last_index:]) - len(strings.TrimLeft(content[last_index:], " \t\r\n"))
+		}
+	}
+
+	results.WriteString(content[last_index:])
+	return results.String()
+}
+
+// Replace variable tokens with values. Escaped tokens such as {\foo} never
+// match a variable and are left alone, Out() turns them back into {foo}.
 func (tpl *TPL) assignments(content_results string) string {
-	// Parse global variables in the content
-	for variable, value := range globalassignments {
-		content_results = strings.Replace(content_results, "{"+variable+"}", value, -1)
+	defer tpl.snapshotGlobals()()
+
+	// Conditionals and filtered tokens first, while locals are still assigned
+	content_results = tpl.conditionals(content_results)
+	content_results = tpl.filters(content_results)
+
+	// Every token is resolved in one pass over the content, arguments of the
+	// include it came from first, then values assigned to this block with
+	// AssignIn(), scoped globals ahead of package globals, function variables
+	// and then locals. The values written are never scanned again, so values
+	// that refer to each other, {a} holding "{b}" and {b} holding "{a}", can't
+	// make substitution loop.
+	results := getBuffer()
+	defer putBuffer(results)
+	scopes := newArgScopes(content_results)
+	attrs := attrRanges(content_results)
+	offset := 0
+
+	// Locals fill only the first token that names them
+	used_locals := make(map[string]bool)
+	used_scoped := make(map[string]bool)
+
+	for {
+		open_index := strings.IndexByte(content_results, '{')
+		if open_index < 0 {
+			break
+		}
+		close_index := strings.IndexByte(content_results[open_index+1:], '}')
+		if close_index < 0 {
+			break
+		}
+		close_index += open_index + 1
+
+		results.WriteString(content_results[:open_index])
+		scopes.read(content_results[:open_index])
+		variable := content_results[open_index+1 : close_index]
+
+		value, ok := scopes.lookup(variable)
+		if !ok && !used_scoped[variable] {
+			value, ok = tpl.scoped_locals[variable]
+			used_scoped[variable] = ok
+		}
+		if !ok {
+			value, ok = tpl.scoped_globals[variable]
+		}
+		if !ok {
+			value, ok = tpl.globals[variable]
+		}
+		if fn, found := tpl.func_assignments[variable]; !ok && found {
+			value, ok = assignable(fn()), true
+		}
+		if !ok && !used_locals[variable] {
+			value, ok = tpl.LocalAssignments[variable]
+			used_locals[variable] = ok
+		}
+
+		// Not a variable, move past the brace so a token inside it still matches
+		if !ok {
+			results.WriteByte('{')
+			content_results = content_results[open_index+1:]
+			offset += open_index + 1
+			continue
+		}
+
+		if inRanges(attrs, offset+open_index) {
+			value = quoteAttr(value)
+		}
+		results.WriteString(value)
+		content_results = content_results[close_index+1:]
+		offset += close_index + 1
 	}
+	results.WriteString(content_results)
 
-	// Parse local variables in the content
+	// Locals are consumed by the block whether they were used or not, the
+	// block's handlers can still depend on them. Locals the block's own
+	// values hid are kept for the next parse.
+	tpl.consumed_locals = make(map[string]string, len(tpl.LocalAssignments)+len(tpl.scoped_locals))
 	for variable, value := range tpl.LocalAssignments {
-		content_results = strings.Replace(content_results, "{"+variable+"}", value, 1)
+		if _, ok := tpl.scoped_locals[variable]; ok {
+			continue
+		}
+		tpl.consumed_locals[variable] = value
 		delete(tpl.LocalAssignments, variable)
 	}
-	return content_results
+	for variable, value := range tpl.scoped_locals {
+		tpl.consumed_locals[variable] = value
+	}
+	tpl.scoped_locals = nil
+	return results.String()
+}
+
+// Copy the package globals so a render sees them as they were when it
+// started, even while other goroutines keep assigning globals. Renders nested
+// in a render, such as blocks rendered by handlers, share the outer copy. The
+// returned function drops the copy again.
+func (tpl *TPL) snapshotGlobals() func() {
+	if tpl.globals != nil {
+		return func() {}
+	}
+
+	globals_mutex.RLock()
+	tpl.globals = make(map[string]string, len(globalassignments))
+	for variable, value := range globalassignments {
+		tpl.globals[variable] = value
+	}
+	globals_mutex.RUnlock()
+
+	return func() { tpl.globals = nil }
+}
+
+// Find the sanitized value a plain {variable} token would be replaced with
+func (tpl *TPL) lookup(variable string) (string, bool) {
+	if value, ok := tpl.scoped_locals[variable]; ok {
+		return value, true
+	}
+	if value, ok := tpl.scoped_globals[variable]; ok {
+		return value, true
+	}
+	if value, ok := tpl.globals[variable]; ok {
+		return value, true
+	}
+	if fn, ok := tpl.func_assignments[variable]; ok {
+		return assignable(fn()), true
+	}
+	value, ok := tpl.LocalAssignments[variable]
+	return value, ok
 }
 
-// Replace handler tokens with handler results
+// Replace handler tokens with handler results. Each pass writes every
+// handler result into one buffer, a handler is called once per pass no matter
+// how many times it appears. Passes repeat while handler results contain
+// more handlers.
 func (tpl *TPL) handlers(content_results string) string {
-	// Run handlers against the content
-	handler_pattern := regexp.MustCompile("<!-- handler: ([A-Za-z0-9_-]+) -->")
-	handler_search := handler_pattern.FindStringSubmatch(content_results)
+	if tpl.handlers_disabled {
+		tpl.consumed_locals = nil
+		return content_results
+	}
+
+	// The locals of the block these handlers belong to, renders nested in
+	// handlers replace the template's own copy
+	locals := tpl.consumed_locals
+	tpl.consumed_locals = nil
+
+	handler_pattern := handlerPattern()
+	matches := handler_pattern.FindAllStringSubmatchIndex(content_results, -1)
+	max_passes := maxHandlerPasses()
+
+	for passes := 0; matches != nil && tpl.aborted == nil; passes++ {
+		// A handler whose output calls itself would expand forever
+		if passes >= max_passes {
+			handler_name := handlerName(content_results, matches[0])
+			if logger := currentLogger(); logger != nil {
+				logger.Printf("gtpl: handler %s still expanding after %d passes", handler_name, max_passes)
+			}
+			tpl.Abort(fmt.Errorf("%w: handler %s still expanding after %d passes", ErrMaxDepthExceeded, handler_name, max_passes))
+			break
+		}
+
+		results := getBuffer()
+		handler_results := make(map[string]handlerOutput)
+		last_index := 0
+
+		for _, match := range matches {
+			// An aborted render leaves the remaining handlers alone
+			if tpl.aborted != nil {
+				break
+			}
+
+			results.WriteString(content_results[last_index:match[0]])
+			last_index = match[1]
 
-	// Loop and do the handler functions
-	for handler_search != nil {
-		handler_comment := handler_search[0]
-		handler_name := handler_search[1]
-		handler_result := ""
+			handler_name := handlerName(content_results, match)
+			attrs, escape_context := "", ""
+			if match[4] >= 0 {
+				attrs = content_results[match[4]:match[5]]
+			}
+			if match[6] >= 0 {
+				escape_context = content_results[match[6]:match[7]]
+			}
 
-		if _, ok := handlers[handler_name]; ok {
-			handler_result = handlers[handler_name]()
+			handler_result, ok := handler_results[handler_name+attrs+"|"+escape_context]
+			if !ok {
+				handler_result = tpl.runHandler(handler_name, attrs, escape_context, locals)
+				handler_results[handler_name+attrs+"|"+escape_context] = handler_result
+			}
+			handler_result.writeTo(results)
 		}
+		results.WriteString(content_results[last_index:])
 
-		content_results = strings.Replace(content_results, handler_comment, handler_result, -1)
-		handler_search = handler_pattern.FindStringSubmatch(content_results)
+		content_results = results.String()
+		putBuffer(results)
+
+		matches = handler_pattern.FindAllStringSubmatchIndex(content_results, -1)
 	}
 	return content_results
 }
 
+// Matches handler directives and, when one is set, the alternative handler
+// syntax. The groups are the directive's handler name, its attributes, its
+// escape context and the alternative syntax's handler name.
+func handlerPattern() *regexp.Regexp {
+	expr := regexp.QuoteMeta(directive_prefix) + `\s*handler\s*:\s*([A-Za-z0-9_-]+)((?:\s+[A-Za-z0-9_\-\.]+\s*=\s*"[^"]*")*)\s*(?:\|\s*(text|attr|url)\s*)?-->`
+	if handler_open != "" {
+		expr += "|" + regexp.QuoteMeta(handler_open) + `\s*([A-Za-z0-9_-]+)\s*` + regexp.QuoteMeta(handler_close)
+	}
+	return compile(expr)
+}
+
+// The handler name from a handlerPattern() match, from whichever syntax matched
+func handlerName(content string, match []int) string {
+	if match[2] >= 0 {
+		return content[match[2]:match[3]]
+	}
+	return content[match[8]:match[9]]
+}
+
+// Split the attributes of a handler directive into a map of unescaped values
+func handlerAttrs(attrs string) map[string]string {
+	attr_pattern := compile(`([A-Za-z0-9_\-\.]+)\s*=\s*"([^"]*)"`)
+
+	values := make(map[string]string)
+	for _, attr := range attr_pattern.FindAllStringSubmatch(attrs, -1) {
+		values[attr[1]] = strings.Replace(desanitize(attr[2]), string(attr_quote_mark), `"`, -1)
+	}
+	return values
+}
+
+// Stands in for double quotes in values substituted into handler attributes,
+// so a value can't close the attribute and add attributes of its own. It's
+// turned back into a quote once the attributes are split.
+const attr_quote_mark = '\uFDD8'
+
+// Mark the double quotes of a value placed in a handler attribute
+func quoteAttr(value string) string {
+	return strings.Replace(value, `"`, string(attr_quote_mark), -1)
+}
+
+// Where the attributes of the handler directives in content are
+func attrRanges(content string) [][]int {
+	if !strings.Contains(content, "handler") {
+		return nil
+	}
+
+	var ranges [][]int
+	for _, match := range handlerPattern().FindAllStringSubmatchIndex(content, -1) {
+		if match[5] > match[4] {
+			ranges = append(ranges, match[4:6])
+		}
+	}
+	return ranges
+}
+
+// Report whether index falls in one of ranges
+func inRanges(ranges [][]int, index int) bool {
+	for _, bounds := range ranges {
+		if index >= bounds[0] && index < bounds[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Escape handler output for where its directive is placed, given as
+// <!-- handler: name | context -->. "text" is for text between tags, "attr"
+// for a quoted attribute value and "url" for a link or source attribute,
+// where script URLs are replaced with "#" like the safeurl filter does.
+func escapeFor(escape_context string, content string) string {
+	switch escape_context {
+	case "attr":
+		return strings.Replace(html.EscapeString(content), "`", "&#96;", -1)
+	case "url":
+		return safeURL(content, nil)
+	default:
+		return html.EscapeString(content)
+	}
+}
+
+// What a handler directive is replaced with, kept the way the handler
+// returned it so neither strings nor bytes are copied into the other
+type handlerOutput struct {
+	text  string
+	bytes []byte
+}
+
+// Write the output into a render buffer
+func (output handlerOutput) writeTo(buffer *bytes.Buffer) {
+	if output.bytes != nil {
+		buffer.Write(output.bytes)
+		return
+	}
+	buffer.WriteString(output.text)
+}
+
+// The output as a string
+func (output handlerOutput) String() string {
+	if output.bytes != nil {
+		return string(output.bytes)
+	}
+	return output.text
+}
+
+// Call a handler by name and return what its directive is replaced with,
+// escaped for the directive's escape context when it has one
+func (tpl *TPL) runHandler(handler_name string, attrs string, escape_context string, locals map[string]string) handlerOutput {
+	if escape_context != "" {
+		return handlerOutput{text: sanitize(escapeFor(escape_context, tpl.callHandler(handler_name, attrs, true, locals).String()))}
+	}
+	return tpl.callHandler(handler_name, attrs, false, locals)
+}
+
+// Call a handler by name with its directive's attributes and the locals of the
+// block it's in. Output of sanitized handlers is left unescaped when the
+// caller escapes it itself.
+func (tpl *TPL) callHandler(handler_name string, attrs string, unescaped bool, locals map[string]string) handlerOutput {
+	if !handlerAllowed(handler_name) {
+		return handlerOutput{}
+	}
+
+	handlers_mutex.RLock()
+	h, ok := handlers[handler_name]
+	handlers_mutex.RUnlock()
+
+	if !ok {
+		handlers_mutex.RLock()
+		fn := default_handler
+		place_holder := missing_handler_place_holder
+		handlers_mutex.RUnlock()
+
+		if fn != nil {
+			return handlerOutput{text: fn(handler_name)}
+		}
+		return handlerOutput{text: strings.Replace(place_holder, "%s", handler_name, -1)}
+	}
+
+	started := time.Now()
+	defer tpl.profileHandler(handler_name, started)
+	metricsHandler(handler_name)
+
+	switch {
+	case h.fn_bytes != nil:
+		return handlerOutput{bytes: h.fn_bytes()}
+	case h.fn_context != nil:
+		return handlerOutput{text: h.fn_context(tpl)}
+	case h.fn_deps != nil:
+		values := make(map[string]string, len(h.deps))
+		for _, dep := range h.deps {
+			value, ok := tpl.lookup(dep)
+			if !ok {
+				value, ok = locals[dep]
+			}
+			if !ok {
+				return handlerOutput{}
+			}
+			values[dep] = plainValue(value)
+		}
+		return handlerOutput{text: h.fn_deps(values)}
+	case h.fn_attrs != nil:
+		return handlerOutput{text: h.fn_attrs(handlerAttrs(attrs))}
+	case h.sanitized && unescaped:
+		return handlerOutput{text: h.fn()}
+	case h.sanitized:
+		return handlerOutput{text: sanitize(html.EscapeString(h.fn()))}
+	default:
+		return handlerOutput{text: h.fn()}
+	}
+}
+
+// The place holder that marks where a block goes in its parent. The trailing
+// NUL keeps a block name from running into text that directly follows it.
+func placeHolder(block_name string) string {
+	return block_name + "\x00"
+}
+
+// Turn cleaned up content into final output
+func (tpl *TPL) output(content string) string {
+	content, _ = tpl.outputMapped(content)
+	return content
+}
+
+// Turn content into final output like output(), along with the source map of
+// it when one is recorded
+func (tpl *TPL) outputMapped(content string) (string, []Mapping) {
+	content = stripArgs(desanitize(content))
+
+	// Marks are left from blocks parsed while a source map was recorded even
+	// once it's turned off
+	var mappings []Mapping
+	if tpl.source_map {
+		content, mappings = tpl.mapSource(content)
+	} else {
+		content = stripMarks(content)
+	}
+
+	if tpl.strip_comments {
+		content = outsideRaw(content, stripComments)
+	}
+
+	if tpl.minify {
+		content = minify(content)
+	}
+
+	if tpl.post_processor != nil {
+		content = tpl.post_processor(content)
+	}
+
+	return content, mappings
+}
+
+// Remove all the position place holders and random whitespacing
+func (tpl *TPL) cleanup(content string) string {
+	if tpl.use_default_value {
+		token_pattern := compile(`\{[A-Za-z0-9_\-\.]+(?:\|[^{}]*)?\}`)
+		content = token_pattern.ReplaceAllLiteralString(content, tpl.default_value)
+	}
+
+	place_holder_pattern := compile(regexp.QuoteMeta("[_GTPL_ROOT_].") + "[A-Za-z0-9_\\-\\.]+\x00")
+	content = place_holder_pattern.ReplaceAllStringFunc(content, func(place_holder string) string {
+		key := strings.TrimSuffix(place_holder, "\x00")
+		switch {
+		case tpl.parsed[key]:
+			return ""
+		case tpl.keep_place_holders:
+			return key
+		}
+		return tpl.fallbacks[key]
+	})
+
+	// A post processor takes over the whitespace cleanup
+	if tpl.post_processor != nil {
+		return content
+	}
+
+	// Source map marks count as whitespace but stay in the content
+	if tpl.source_map {
+		re := compile(`(?m)^[\s\x{FDD1}-\x{FDEF}]*$[\r\n]*|[\r\n]+[\s\x{FDD1}-\x{FDEF}]+\z`)
+		return re.ReplaceAllStringFunc(content, keepMarks)
+	}
+
+	re := compile(`(?m)^\s*$[\r\n]*|[\r\n]+\s+\z`)
+	return re.ReplaceAllString(content, "")
+}
+
+// Get an empty buffer from the pool of render buffers
+func getBuffer() *bytes.Buffer {
+	buffer := buffers.Get().(*bytes.Buffer)
+	buffer.Reset()
+	return buffer
+}
+
+// Return a buffer to the pool, oversized ones are left to the garbage
+// collector so one huge page doesn't pin its memory for good
+func putBuffer(buffer *bytes.Buffer) {
+	if buffer.Cap() > max_pooled_buffer {
+		return
+	}
+	buffers.Put(buffer)
+}
+
+// Compile a regular expression, or reuse it when it was compiled before
+func compile(expr string) *regexp.Regexp {
+	patterns_mutex.Lock()
+	defer patterns_mutex.Unlock()
+
+	if re, ok := patterns[expr]; ok {
+		return re
+	}
+
+	re := regexp.MustCompile(expr)
+	patterns[expr] = re
+	return re
+}
+
+// Marks the characters sanitize() escaped. U+FDD0 is a noncharacter that
+// never shows up in real text, so removing it can't change content the way
+// removing a backslash could.
+const sanitize_mark = "\uFDD0"
+
 // Prevent template injection
 func sanitize(content string) string {
-	content = strings.Replace(content, "[_GTPL_ROOT_]", "[\\_GTPL_ROOT_]", -1)
-	content = strings.Replace(content, "<!--", "<!--\\", -1)
-	content = strings.Replace(content, "{", "{\\", -1)
+	content = stripMarks(content)
+	content = strings.Replace(content, "[_GTPL_ROOT_]", "["+sanitize_mark+"_GTPL_ROOT_]", -1)
+	content = strings.Replace(content, directive_prefix, directive_prefix+sanitize_mark, -1)
+	content = strings.Replace(content, "{", "{"+sanitize_mark, -1)
+	if handler_open != "" {
+		content = strings.Replace(content, handler_open, handler_open+sanitize_mark, -1)
+	}
 	return content
 }
 
-// Remove sanitizations...
+// Remove sanitizations
 func desanitize(content string) string {
-	content = strings.Replace(content, "[\\_GTPL_ROOT_]", "[_GTPL_ROOT_]", -1)
-	content = strings.Replace(content, "<!--\\", "<!--", -1)
-	content = strings.Replace(content, "{\\", "{", -1)
-	return content
+	return strings.Replace(content, sanitize_mark, "", -1)
+}
+
+// Turn {\foo} written in a template body into an escaped brace, so it comes
+// out as a literal {foo}
+func escapeTemplate(content string) string {
+	return strings.Replace(content, "{\\", "{"+sanitize_mark, -1)
 }
@@ -0,0 +1,532 @@
+package gtpl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestEscapedTokenStaysLiteral(t *testing.T) {
+	tpl, err := Open([]byte(`<p>{\name} is {name}</p><!-- block: row -->[{\name}={name}]<!-- /block: row -->`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tpl.Assign("name", "Sam")
+	tpl.Parse("row")
+	tpl.Assign("name", "Sam")
+	tpl.Parse(RootBlock)
+
+	want := `<p>{name} is Sam</p>[{name}=Sam]`
+	if got := tpl.Out(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseErrReportsUnknownBlock(t *testing.T) {
+	tpl, _ := Open([]byte(`<!-- block: row -->{n}<!-- /block: row -->`))
+
+	if err := tpl.ParseErr("rows"); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("ParseErr(rows) = %v, want ErrBlockNotFound", err)
+	}
+	if err := tpl.ParseErr("row.cell"); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("ParseErr(row.cell) = %v, want ErrBlockNotFound", err)
+	}
+}
+
+func TestParseErrRendersLikeParse(t *testing.T) {
+	source := []byte(`<ul><!-- block: row --><li>{n}</li><!-- /block: row --></ul>`)
+	parsed, _ := Open(source)
+	checked, _ := Open(source)
+
+	for _, n := range []string{"a", "b"} {
+		parsed.Assign("n", n)
+		parsed.Parse("row")
+		checked.Assign("n", n)
+		if err := checked.ParseErr("row"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if parsed.Out() != checked.Out() {
+		t.Errorf("Parse() and ParseErr() rendered differently")
+	}
+}
+
+// A page of 200 blocks, half of them nested in the other half
+func manyBlocks() []byte {
+	var source strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&source, "<div>\n<!-- block: item%d -->\n<h2>{title}</h2>\n<!-- block: detail%d --><p>{text}</p><!-- /block: detail%d -->\n<!-- /block: item%d -->\n</div>\n", i, i, i, i)
+	}
+	return []byte(source.String())
+}
+
+func BenchmarkOpen200Blocks(b *testing.B) {
+	source := manyBlocks()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Open(source); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDirectiveSpacing(t *testing.T) {
+	AddHandler("spacing_test", func() string { return "H" })
+
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{"canonical", `[<!-- block: foo -->{v}<!-- /block: foo -->|<!-- handler: spacing_test -->]`},
+		{"no spaces", `[<!--block:foo-->{v}<!--/block:foo-->|<!--handler:spacing_test-->]`},
+		{"no space after colon", `[<!-- block:foo -->{v}<!-- /block:foo -->|<!-- handler:spacing_test -->]`},
+		{"no space inside markers", `[<!--block: foo-->{v}<!--/block: foo-->|<!--handler: spacing_test-->]`},
+		{"space before colon", `[<!-- block : foo -->{v}<!-- / block : foo -->|<!-- handler : spacing_test -->]`},
+		{"extra spaces", `[<!--   block:   foo   -->{v}<!--   /block:   foo   -->|<!--   handler:   spacing_test   -->]`},
+		{"newlines", "[<!--\nblock:\nfoo\n-->{v}<!--\n/block:\nfoo\n-->|<!--\nhandler:\nspacing_test\n-->]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tpl, err := Open([]byte(test.source))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tpl.Assign("v", "V")
+			if err := tpl.ParseErr("foo"); err != nil {
+				t.Fatal(err)
+			}
+			if got := tpl.Out(); got != "[V|H]" {
+				t.Errorf("got %q, want %q", got, "[V|H]")
+			}
+		})
+	}
+}
+
+// A component library where the same block names show up in many components
+// and under many parents
+func componentLibrary() [][]byte {
+	var library [][]byte
+	for _, component := range []string{"nav", "table", "list", "cards", "tabs", "menu", "footer", "sidebar", "form", "alerts"} {
+		var source strings.Builder
+		fmt.Fprintf(&source, "<section class=\"%s\">\n", component)
+		for _, section := range []string{"header", "body", "footer"} {
+			fmt.Fprintf(&source, "<!-- block: %s -->\n<div class=\"%s\">\n", section, section)
+			source.WriteString("<!-- block: item --><a href=\"{url}\">{label}</a><!-- block: badge --><b>{count}</b><!-- /block: badge --><!-- /block: item -->\n")
+			source.WriteString("<!-- block: empty --><p>{empty_text}</p><!-- /block: empty -->\n")
+			fmt.Fprintf(&source, "</div>\n<!-- /block: %s -->\n", section)
+		}
+		source.WriteString("</section>\n")
+		library = append(library, []byte(source.String()))
+	}
+	return library
+}
+
+func BenchmarkOpenComponentLibrary(b *testing.B) {
+	library := componentLibrary()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, source := range library {
+			if _, err := Open(source); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestAssignFuncPerOccurrence(t *testing.T) {
+	tpl, _ := Open([]byte(`{token} {token} {token}`))
+
+	calls := 0
+	tpl.AssignFunc("token", func() string {
+		calls++
+		return fmt.Sprint(calls)
+	})
+	tpl.Parse(RootBlock)
+
+	if got := tpl.Out(); got != "1 2 3" {
+		t.Errorf("got %q, want %q", got, "1 2 3")
+	}
+}
+
+func TestAssignFuncSafeDefault(t *testing.T) {
+	SetSafeDefault(true)
+	defer SetSafeDefault(false)
+
+	tpl, _ := Open([]byte(`{html}`))
+	tpl.AssignFunc("html", func() string { return "<b>" })
+	tpl.Parse(RootBlock)
+
+	if got := tpl.Out(); got != "&lt;b&gt;" {
+		t.Errorf("got %q, want %q", got, "&lt;b&gt;")
+	}
+}
+
+func TestOpenEmpty(t *testing.T) {
+	for _, source := range []string{"", " ", "\n\t \r\n"} {
+		tpl, err := Open([]byte(source))
+		if err != nil {
+			t.Fatalf("Open(%q): %v", source, err)
+		}
+		if err := tpl.ParseErr("anything"); !errors.Is(err, ErrBlockNotFound) {
+			t.Errorf("Open(%q): ParseErr() = %v, want ErrBlockNotFound", source, err)
+		}
+		if got := tpl.Out(); got != "" {
+			t.Errorf("Open(%q): Out() = %q, want an empty string", source, got)
+		}
+	}
+}
+
+func TestOpenEmptyFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "empty.html")
+	if err := os.WriteFile(filename, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tpl, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tpl.Out(); got != "" {
+		t.Errorf("Out() = %q, want an empty string", got)
+	}
+}
+
+func TestPrefixNamedLocals(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		tpl, _ := Open([]byte(`<!-- block: row -->{user}|{username}<!-- /block: row -->`))
+		tpl.Assign("user", "U")
+		tpl.Assign("username", "N")
+		tpl.Parse("row")
+
+		if got := tpl.Out(); got != "U|N" {
+			t.Fatalf("got %q, want %q", got, "U|N")
+		}
+	}
+}
+
+func TestSelfReferentialValuesDontLoop(t *testing.T) {
+	tpl, _ := Open([]byte(`{loop_test_a}|{loop_test_b}`))
+	tpl.WithScopedGlobals()
+	tpl.AssignGlobal("loop_test_a", "{loop_test_b}")
+	tpl.AssignGlobal("loop_test_b", "{loop_test_a}")
+	tpl.Parse(RootBlock)
+
+	want := "{loop_test_b}|{loop_test_a}"
+	if got := tpl.Out(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func BenchmarkOutWithHandlers(b *testing.B) {
+	header := strings.Repeat("<nav>menu</nav>", 200)
+	footer := []byte(strings.Repeat("<footer>links</footer>", 200))
+	AddHandler("bench_header", func() string { return header })
+	AddHandlerBytes("bench_footer", func() []byte { return footer })
+
+	var source strings.Builder
+	source.WriteString("<!-- handler: bench_header -->\n")
+	source.WriteString("<!-- block: row --><p>{title} {text}</p><!-- /block: row -->\n")
+	source.WriteString("<!-- handler: bench_footer -->\n")
+	compiled, err := Compile([]byte(source.String()))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tpl := compiled.New()
+		for row := 0; row < 20; row++ {
+			tpl.Assign("title", "Title")
+			tpl.Assign("text", "Some text for the row")
+			tpl.Parse("row")
+		}
+		tpl.Out()
+	}
+}
+
+func TestBlockAndHandlerNameCollision(t *testing.T) {
+	AddHandler("collide", func() string { return "H" })
+
+	for i := 0; i < 10; i++ {
+		tpl, err := Open([]byte(`[<!-- handler: collide -->]<!-- block: collide -->({v}<!-- handler: collide -->)<!-- /block: collide -->`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"collide is used as both a block and a handler name"}
+		if got := tpl.Warnings(); !reflect.DeepEqual(got, want) {
+			t.Errorf("Warnings() = %q, want %q", got, want)
+		}
+
+		tpl.Assign("v", "V")
+		tpl.Parse("collide")
+		if got := tpl.Out(); got != "[H](VH)" {
+			t.Fatalf("got %q, want %q", got, "[H](VH)")
+		}
+	}
+}
+
+func BenchmarkOpenWithoutBlocks(b *testing.B) {
+	source := []byte(strings.Repeat("<p class=\"{class}\">{title} by {author}, {date}</p>\n", 200))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Open(source); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestOpenStripsBOM(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/bom.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(fixture, []byte("\xef\xbb\xbf")) {
+		t.Fatal("testdata/bom.html lost its byte order mark")
+	}
+
+	opened, err := Open("testdata/bom.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed, err := OpenReader(bytes.NewReader(fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "<h1>Hello</h1>\n<p>body</p>\n"
+	for name, tpl := range map[string]*TPL{"Open": &opened, "OpenReader": &streamed} {
+		tpl.Assign("title", "Hello")
+		if err := tpl.ParseErr("title"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := tpl.Out(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestAssignInLeavesLocals(t *testing.T) {
+	tpl, _ := Open([]byte(`<!-- block: a -->a={name} <!-- /block: a --><!-- block: b -->b={name}<!-- /block: b -->`))
+
+	tpl.Assign("name", "local")
+	tpl.AssignIn("a", "name", "scoped")
+	tpl.Parse("a")
+	tpl.Parse("b")
+
+	want := `a=scoped b=local`
+	if got := tpl.Out(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSanitizeRoundTrip(t *testing.T) {
+	values := []string{
+		`{\name}`,
+		`{name}`,
+		`<!--\ block: row -->`,
+		`<!-- handler: h -->`,
+		`[_GTPL_ROOT_]`,
+		`C:\path\{dir}\\`,
+	}
+	for _, value := range values {
+		tpl, _ := Open([]byte(`<p>{v}</p>`))
+		tpl.Assign("v", value)
+		tpl.Assign("name", "filled")
+		tpl.Parse(RootBlock)
+
+		if got, want := tpl.Out(), "<p>"+value+"</p>"; got != want {
+			t.Errorf("Assign(%q): got %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestBlockSourceRoundTrip(t *testing.T) {
+	source := `<!-- block: row -->{\name}|{name}|<!--\ x -->|C:\dir\\<!-- block: cell -->[{\n}]<!-- /block: cell --><!-- /block: row -->`
+	render := func(tpl *TPL) string {
+		tpl.Assign("n", "1")
+		tpl.Parse("row.cell")
+		tpl.Assign("name", "Sam")
+		tpl.Parse("row")
+		return tpl.Out()
+	}
+
+	original, _ := Open([]byte(source))
+	block_source, err := original.GetBlockSource("row")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{\name}|{name}|<!--\ x -->|C:\dir\\<!-- block: cell -->[{\n}]<!-- /block: cell -->`
+	if block_source != want {
+		t.Errorf("GetBlockSource(row) = %q, want %q", block_source, want)
+	}
+
+	replaced, _ := Open([]byte(source))
+	if err := replaced.SetBlock("row", block_source); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := render(&replaced), render(&original); got != want {
+		t.Errorf("after SetBlock(GetBlockSource()): got %q, want %q", got, want)
+	}
+}
+
+func TestMaxHandlerExpansions(t *testing.T) {
+	defer SetMaxHandlerExpansions(1000)
+	AddHandler("expands_forever", func() string { return "x<!-- handler: expands_forever -->" })
+
+	var wait sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for index := 0; index < 20; index++ {
+				tpl, _ := Open([]byte(`<!-- handler: expands_forever -->`))
+				if _, err := tpl.OutErr(); !errors.Is(err, ErrMaxDepthExceeded) {
+					t.Errorf("OutErr() = %v, want ErrMaxDepthExceeded", err)
+				}
+			}
+		}()
+	}
+	for index := 0; index < 20; index++ {
+		SetMaxHandlerExpansions(5 + index)
+	}
+	wait.Wait()
+}
+
+func TestAttrHandlerValuesCantAddAttrs(t *testing.T) {
+	var got map[string]string
+	AddAttrHandler("attr_inject", func(attrs map[string]string) string {
+		got = attrs
+		return ""
+	})
+
+	tpl, _ := Open([]byte(`<!-- handler: attr_inject label="{label}" title="{label|number}" -->`))
+	tpl.Assign("label", `x" admin="true`)
+	tpl.Parse(RootBlock)
+	tpl.Out()
+
+	want := map[string]string{"label": `x" admin="true`, "title": `x" admin="true`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestKeepPlaceholders(t *testing.T) {
+	tpl, _ := Open([]byte(`[<!-- block: empty --><!-- /block: empty -->][<!-- block: unparsed -->x<!-- /block: unparsed -->]`))
+	tpl.SetKeepPlaceholders(true)
+	tpl.Parse("empty")
+
+	want := `[][[_GTPL_ROOT_].unparsed]`
+	if got := tpl.Out(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSetMissingHandlerPlaceholderWhileRendering(t *testing.T) {
+	defer SetMissingHandlerPlaceholder("")
+
+	var wait sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for index := 0; index < 100; index++ {
+				tpl, _ := Open([]byte(`<!-- handler: placeholder_race_missing -->`))
+				tpl.Out()
+			}
+		}()
+	}
+	for index := 0; index < 100; index++ {
+		SetMissingHandlerPlaceholder("[missing: %s]")
+	}
+	wait.Wait()
+
+	tpl, _ := Open([]byte(`<!-- handler: placeholder_race_missing -->`))
+	if got, want := tpl.Out(), "[missing: placeholder_race_missing]"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSetLoggerWhileOpening(t *testing.T) {
+	defer SetLogger(nil)
+	AddHandler("logger_race", func() string { return "" })
+
+	var wait sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for index := 0; index < 100; index++ {
+				Open([]byte(`<!-- block: logger_race --><!-- /block: logger_race -->`))
+			}
+		}()
+	}
+	for index := 0; index < 100; index++ {
+		SetLogger(log.New(io.Discard, "", 0))
+	}
+	wait.Wait()
+
+	var output bytes.Buffer
+	SetLogger(log.New(&output, "", 0))
+	Open([]byte(`<!-- block: logger_race --><!-- /block: logger_race -->`))
+	if !strings.Contains(output.String(), "logger_race") {
+		t.Errorf("name collision wasn't logged: %q", output.String())
+	}
+}
+
+func TestHandlerEscapeContexts(t *testing.T) {
+	AddHandler("escape_markup", func() string { return `<b title="a">'x' ` + "`y`" + ` & z</b>` })
+	AddHandler("escape_script_url", func() string { return "javascript:alert(1)" })
+	AddHandler("escape_url", func() string { return "/search?q=a&b=<c>" })
+	AddHandlerSanitized("escape_sanitized", func() string { return `<i>&</i>` })
+
+	tests := []struct {
+		directive string
+		want      string
+	}{
+		{`<!-- handler: escape_markup | text -->`, `&lt;b title=&#34;a&#34;&gt;&#39;x&#39; ` + "`y`" + ` &amp; z&lt;/b&gt;`},
+		{`<!-- handler: escape_markup | attr -->`, `&lt;b title=&#34;a&#34;&gt;&#39;x&#39; &#96;y&#96; &amp; z&lt;/b&gt;`},
+		{`<!-- handler: escape_script_url | url -->`, `#`},
+		{`<!-- handler: escape_url | url -->`, `/search?q=a&amp;b=&lt;c&gt;`},
+		{`<!-- handler: escape_sanitized -->`, `&lt;i&gt;&amp;&lt;/i&gt;`},
+		{`<!-- handler: escape_sanitized | text -->`, `&lt;i&gt;&amp;&lt;/i&gt;`},
+		{`<!-- handler: escape_sanitized | attr -->`, `&lt;i&gt;&amp;&lt;/i&gt;`},
+	}
+	for _, test := range tests {
+		tpl, err := Open([]byte(test.directive))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tpl.Out(); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.directive, got, test.want)
+		}
+	}
+}
+
+func TestUsesVariable(t *testing.T) {
+	tpl, _ := Open([]byte(`{plain}{filtered|number}{\escaped}<!-- block: row --><!-- if: flag -->x<!-- /if --><!-- /block: row -->`))
+
+	for name, want := range map[string]bool{
+		"plain":    true,
+		"filtered": true,
+		"flag":     true,
+		"escaped":  false,
+		"fla":      false,
+		"missing":  false,
+	} {
+		if got := tpl.UsesVariable(name); got != want {
+			t.Errorf("UsesVariable(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package gtpl
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Directory that template paths are resolved against, empty for the working
+// directory. template_dir_mutex guards path_sandbox as well.
+var template_dir = ""
+var template_dir_mutex sync.RWMutex
+
+// Reject every path that resolves outside of the template directory
+var path_sandbox = false
+
+// How deep includes may nest before giving up, this also stops include cycles
+const max_include_depth = 32
+
+// Returned when a template path resolves outside of the template directory.
+var ErrPathOutsideTemplateDir = errors.New("gtpl: path is outside of the template directory")
+
+// Resolve relative template paths, for Open() and for include directives,
+// against dir instead of the working directory. Relative paths that climb out
+// of dir with ".." are rejected.
+func SetTemplateDir(dir string) {
+	template_dir_mutex.Lock()
+	defer template_dir_mutex.Unlock()
+	template_dir = dir
+}
+
+// The directory set with SetTemplateDir() and whether SetPathSandbox() is on
+func templateDir() (string, bool) {
+	template_dir_mutex.RLock()
+	defer template_dir_mutex.RUnlock()
+	return template_dir, path_sandbox
+}
+
+// Confine Open() and includes to the template directory, or to the working
+// directory when none is set. Absolute paths and symlinks are resolved first
+// and anything ending up outside returns ErrPathOutsideTemplateDir. Turn this
+// on whenever templates, and so their includes, come from users.
+func SetPathSandbox(enabled bool) {
+	template_dir_mutex.Lock()
+	defer template_dir_mutex.Unlock()
+	path_sandbox = enabled
+}
+
+// Resolve a template path against the template directory
+func resolvePath(filename string) (string, error) {
+	dir, sandboxed := templateDir()
+	if sandboxed {
+		return sandboxedPath(dir, filename)
+	}
+
+	if dir == "" || filepath.IsAbs(filename) {
+		return filename, nil
+	}
+
+	resolved := filepath.Join(dir, filename)
+	if !within(dir, resolved) {
+		return "", fmt.Errorf("%w: %s", ErrPathOutsideTemplateDir, filename)
+	}
+
+	return resolved, nil
+}
+
+// Resolve a template path with symlinks followed, and make sure it stays
+// inside of the template directory dir
+func sandboxedPath(dir string, filename string) (string, error) {
+	root := dir
+	if root == "" {
+		root = "."
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+
+	resolved := filename
+	if !filepath.IsAbs(resolved) {
+		resolved = filepath.Join(root, resolved)
+	}
+
+	resolved, err = filepath.EvalSymlinks(resolved)
+	if err != nil {
+		return "", err
+	}
+
+	if !within(root, resolved) {
+		return "", fmt.Errorf("%w: %s", ErrPathOutsideTemplateDir, filename)
+	}
+
+	return resolved, nil
+}
+
+// Check if a path is inside of a directory
+func within(dir string, path string) bool {
+	relative, err := filepath.Rel(dir, path)
+	return err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator))
+}
+
+// Read a template file, resolving its path first. With a file system the
+// file is read from it instead, relative to its root.
+func readTemplate(fsys fs.FS, filename string) ([]byte, error) {
+	if fsys != nil {
+		filename = strings.TrimPrefix(path.Clean(filename), "/")
+		if !fs.ValidPath(filename) {
+			return nil, fmt.Errorf("%w: %s", ErrPathOutsideTemplateDir, filename)
+		}
+		return fs.ReadFile(fsys, filename)
+	}
+
+	resolved, err := resolvePath(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(resolved)
+}
+
+// Replace include directives with the content of the files they name,
+// recursively, so the combined content can be scanned for blocks as a whole.
+// Included files are read from fsys when it isn't nil.
+func include(fsys fs.FS, content string, depth int) (string, error) {
+	include_pattern := includePattern()
+
+	if !include_pattern.MatchString(content) {
+		return content, nil
+	}
+
+	if depth >= max_include_depth {
+		return "", fmt.Errorf("%w: includes nested more than %d deep, is a file including itself?", ErrMaxDepthExceeded, max_include_depth)
+	}
+
+	var results strings.Builder
+	last_index := 0
+
+	for _, match := range include_pattern.FindAllStringSubmatchIndex(content, -1) {
+		filename := content[match[2]:match[3]]
+
+		fbuffer, err := readTemplate(fsys, filename)
+		if err != nil {
+			return "", err
+		}
+
+		included, err := include(fsys, string(stripBOM(fbuffer)), depth+1)
+		if err != nil {
+			return "", err
+		}
+
+		if err := validateInclude(filename, included); err != nil {
+			return "", err
+		}
+		included = withArgs(included, content[match[4]:match[5]])
+
+		results.WriteString(content[last_index:match[0]])
+		results.WriteString(included)
+		last_index = match[1]
+	}
+
+	results.WriteString(content[last_index:])
+	return results.String(), nil
+}
+
+// Matches include directives. The groups are the path and the arguments,
+// <!-- include: nav.html with active="home" --> passes active to nav.html.
+func includePattern() *regexp.Regexp {
+	return compile(regexp.QuoteMeta(directive_prefix) + `\s*include\s*:\s*([A-Za-z0-9_\-\./]+)((?:\s+with)?(?:\s+[A-Za-z0-9_\-\.]+\s*=\s*"[^"]*")*)\s*-->`)
+}
+
+// Noncharacters wrapping content included with arguments, so the arguments
+// fill that content only while it's rendered. The content is preceded by
+// include_args_open, the arguments as name=value pairs split by
+// include_args_split with the values hex encoded, and include_args_end, and
+// followed by include_args_close.
+const include_args_open = '\uFDD4'
+const include_args_split = '\uFDD5'
+const include_args_end = '\uFDD6'
+const include_args_close = '\uFDD7'
+
+// Wrap included content in the arguments its include directive passes. They
+// only apply to that content and take precedence over globals and locals.
+func withArgs(content string, args string) string {
+	header := argsHeader(args)
+	if header == "" {
+		return content
+	}
+	return header + content + string(include_args_close)
+}
+
+// The marks that start content included with args, empty without arguments
+func argsHeader(args string) string {
+	arg_pattern := compile(`([A-Za-z0-9_\-\.]+)\s*=\s*"([^"]*)"`)
+
+	matches := arg_pattern.FindAllStringSubmatch(args, -1)
+	if matches == nil {
+		return ""
+	}
+
+	var header strings.Builder
+	header.WriteRune(include_args_open)
+	for index, arg := range matches {
+		if index > 0 {
+			header.WriteRune(include_args_split)
+		}
+		header.WriteString(arg[1] + "=" + hex.EncodeToString([]byte(arg[2])))
+	}
+	header.WriteRune(include_args_end)
+	return header.String()
+}
+
+// The include arguments in effect at a point of rendered content, found by
+// reading the content before it in order
+type argScopes struct {
+	// The marks that started the includes still open, outermost first
+	headers []string
+
+	// Their arguments, sanitized like assignments
+	args []map[string]string
+}
+
+// Start following the include arguments of content, nil when it has none
+func newArgScopes(content string) *argScopes {
+	if !strings.ContainsRune(content, include_args_open) {
+		return nil
+	}
+	return &argScopes{}
+}
+
+// Follow the includes that start and end in text, the next part of the content
+func (scopes *argScopes) read(text string) {
+	if scopes == nil {
+		return
+	}
+
+	for {
+		index := strings.IndexAny(text, string(include_args_open)+string(include_args_close))
+		if index < 0 {
+			return
+		}
+
+		if strings.HasPrefix(text[index:], string(include_args_close)) {
+			if len(scopes.headers) > 0 {
+				scopes.headers = scopes.headers[:len(scopes.headers)-1]
+				scopes.args = scopes.args[:len(scopes.args)-1]
+			}
+			text = text[index+len(string(include_args_close)):]
+			continue
+		}
+
+		end := strings.IndexRune(text[index:], include_args_end)
+		if end < 0 {
+			return
+		}
+		end += index + len(string(include_args_end))
+
+		scopes.headers = append(scopes.headers, text[index:end])
+		scopes.args = append(scopes.args, parseArgs(text[index:end]))
+		text = text[end:]
+	}
+}
+
+// The sanitized arguments of the marks that start an include
+func parseArgs(header string) map[string]string {
+	header = strings.TrimPrefix(header, string(include_args_open))
+	header = strings.TrimSuffix(header, string(include_args_end))
+
+	args := make(map[string]string)
+	for _, arg := range strings.Split(header, string(include_args_split)) {
+		pair := strings.SplitN(arg, "=", 2)
+		if len(pair) < 2 {
+			continue
+		}
+		value, _ := hex.DecodeString(pair[1])
+		args[pair[0]] = sanitize(string(value))
+	}
+	return args
+}
+
+// Find the value the innermost include passing variable gives it
+func (scopes *argScopes) lookup(variable string) (string, bool) {
+	if scopes == nil {
+		return "", false
+	}
+
+	for index := len(scopes.args) - 1; index >= 0; index-- {
+		if value, ok := scopes.args[index][variable]; ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// The include arguments in effect at index of content
+func argsAt(content string, index int) *argScopes {
+	scopes := newArgScopes(content)
+	scopes.read(content[:index])
+	return scopes
+}
+
+// Wrap a block's content, found at index of its parent, in the includes it was
+// inside of, so their arguments still apply once it's stored on its own
+func wrapArgs(parent string, index int, content string) string {
+	scopes := argsAt(parent, index)
+	if scopes == nil || len(scopes.headers) == 0 {
+		return content
+	}
+	return strings.Join(scopes.headers, "") + content + strings.Repeat(string(include_args_close), len(scopes.headers))
+}
+
+// The names every include in content passes
+func argNames(content string) map[string]bool {
+	names := make(map[string]bool)
+	for {
+		index := strings.IndexRune(content, include_args_open)
+		if index < 0 {
+			return names
+		}
+		content = content[index:]
+
+		end := strings.IndexRune(content, include_args_end)
+		if end < 0 {
+			return names
+		}
+		for name := range parseArgs(content[:end]) {
+			names[name] = true
+		}
+		content = content[end:]
+	}
+}
+
+// Remove the include argument marks from content
+func stripArgs(content string) string {
+	if !strings.ContainsRune(content, include_args_close) {
+		return content
+	}
+
+	var results strings.Builder
+	for {
+		index := strings.IndexAny(content, string(include_args_open)+string(include_args_close))
+		if index < 0 {
+			break
+		}
+		results.WriteString(content[:index])
+
+		if strings.HasPrefix(content[index:], string(include_args_close)) {
+			content = content[index+len(string(include_args_close)):]
+			continue
+		}
+
+		end := strings.IndexRune(content[index:], include_args_end)
+		if end < 0 {
+			content = content[index+len(string(include_args_open)):]
+			continue
+		}
+		content = content[index+end+len(string(include_args_end)):]
+	}
+	results.WriteString(content)
+	return results.String()
+}
@@ -0,0 +1,157 @@
+package gtpl
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestIncludeArgs(t *testing.T) {
+	dir := t.TempDir()
+	nav := `[{active}][{active|ternary:on:off}]<!-- if: active -->set<!-- /if --><!-- block: item -->({active})<!-- /block: item -->`
+	if err := os.WriteFile(filepath.Join(dir, "nav.html"), []byte(nav), 0644); err != nil {
+		t.Fatal(err)
+	}
+	SetTemplateDir(dir)
+	defer SetTemplateDir("")
+
+	source := `<!-- include: nav.html with active="home" -->|{active}`
+	opened, err := Open([]byte(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed, err := OpenReader(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tpl := range map[string]*TPL{"Open": &opened, "OpenReader": &streamed} {
+		tpl.Parse("item")
+		tpl.Assign("active", "other")
+		tpl.Parse(RootBlock)
+
+		want := `[home][on]set(home)|other`
+		if got := tpl.Out(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestNestedIncludeArgs(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"outer.html": `outer[{a}{b}]<!-- include: inner.html with b="B2" -->`,
+		"inner.html": `inner[{a}{b}]<!-- block: x -->x[{a}{b}]<!-- /block: x -->`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	SetTemplateDir(dir)
+	defer SetTemplateDir("")
+
+	source := `<!-- include: outer.html with a="{b}<!-- a" b="B1" -->{a}`
+	opened, err := Open([]byte(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed, err := OpenReader(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tpl := range map[string]*TPL{"Open": &opened, "OpenReader": &streamed} {
+		tpl.Parse("x")
+		tpl.Parse(RootBlock)
+
+		want := `outer[{b}<!-- aB1]inner[{b}<!-- aB2]x[{b}<!-- aB2]{a}`
+		if got := tpl.Out(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSetTemplateDirWhileOpening(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "part.html"), []byte("part"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer SetTemplateDir("")
+
+	var wait sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for index := 0; index < 100; index++ {
+				Open([]byte(`<!-- include: part.html -->`))
+			}
+		}()
+	}
+	for index := 0; index < 100; index++ {
+		SetTemplateDir(dir)
+	}
+	wait.Wait()
+
+	tpl, err := Open([]byte(`<!-- include: part.html -->`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tpl.Out(); got != "part" {
+		t.Errorf("got %q, want %q", got, "part")
+	}
+}
+
+func TestPathSandbox(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	secret := filepath.Join(base, "secret.html")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for filename, content := range map[string]string{
+		secret:                               "secret",
+		filepath.Join(root, "page.html"):     "page",
+		filepath.Join(root, "includes.html"): "<!-- include: ../secret.html -->",
+	} {
+		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(secret, filepath.Join(root, "link.html")); err != nil {
+		t.Skipf("symlinks aren't supported: %v", err)
+	}
+
+	SetTemplateDir(root)
+	SetPathSandbox(true)
+	defer SetTemplateDir("")
+	defer SetPathSandbox(false)
+
+	if tpl, err := Open("page.html"); err != nil || tpl.Out() != "page" {
+		t.Fatalf("Open(page.html) = %q, %v, want the page", tpl.Out(), err)
+	}
+
+	tests := []struct {
+		name   string
+		source interface{}
+	}{
+		{"dot dot escape", "../secret.html"},
+		{"absolute path", secret},
+		{"symlink leaving the root", "link.html"},
+		{"include directive", []byte(`<!-- include: ../secret.html -->`)},
+		{"include in an included file", "includes.html"},
+	}
+	for _, test := range tests {
+		tpl, err := Open(test.source)
+		if !errors.Is(err, ErrPathOutsideTemplateDir) {
+			t.Errorf("%s: Open() = %v, want ErrPathOutsideTemplateDir", test.name, err)
+		}
+		if strings.Contains(tpl.Out(), "secret") {
+			t.Errorf("%s: the file outside the root was read", test.name)
+		}
+	}
+}
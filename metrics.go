@@ -0,0 +1,70 @@
+package gtpl
+
+import (
+	"sync"
+	"time"
+)
+
+// Receives counts and timings from the package for monitoring, such as
+// Prometheus counters and a histogram of render durations. The methods are
+// called from whichever goroutine is doing the work, so they must be safe to
+// call concurrently, and they should return quickly.
+type MetricsSink interface {
+	// A template was opened and parsed into blocks
+	TemplateOpened()
+
+	// Opening a template failed because it couldn't be parsed
+	ParseFailed(err error)
+
+	// A registered handler was called
+	HandlerCalled(name string)
+
+	// Out() rendered a template, taking duration
+	RenderCompleted(duration time.Duration)
+}
+
+// Where metrics are sent, nothing is recorded when nil
+var metrics MetricsSink
+var metrics_mutex sync.RWMutex
+
+// Send metrics to sink, nil stops sending them. It's usually called at
+// startup, work already under way when it's called may report to the previous
+// sink.
+func SetMetrics(sink MetricsSink) {
+	metrics_mutex.Lock()
+	defer metrics_mutex.Unlock()
+	metrics = sink
+}
+
+// The sink metrics are sent to, nil when there isn't one
+func metricsSink() MetricsSink {
+	metrics_mutex.RLock()
+	defer metrics_mutex.RUnlock()
+	return metrics
+}
+
+// Count a template that was opened or failed to parse
+func metricsOpened(err error) {
+	metrics := metricsSink()
+	switch {
+	case metrics == nil:
+	case err != nil:
+		metrics.ParseFailed(err)
+	default:
+		metrics.TemplateOpened()
+	}
+}
+
+// Count a handler call
+func metricsHandler(handler_name string) {
+	if metrics := metricsSink(); metrics != nil {
+		metrics.HandlerCalled(handler_name)
+	}
+}
+
+// Count a render that began at started
+func metricsRendered(started time.Time) {
+	if metrics := metricsSink(); metrics != nil {
+		metrics.RenderCompleted(time.Since(started))
+	}
+}
@@ -0,0 +1,47 @@
+package gtpl
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Counts what it's sent
+type countingSink struct {
+	opened, failed, handlers, rendered int64
+}
+
+func (sink *countingSink) TemplateOpened()                 { atomic.AddInt64(&sink.opened, 1) }
+func (sink *countingSink) ParseFailed(err error)           { atomic.AddInt64(&sink.failed, 1) }
+func (sink *countingSink) HandlerCalled(name string)       { atomic.AddInt64(&sink.handlers, 1) }
+func (sink *countingSink) RenderCompleted(d time.Duration) { atomic.AddInt64(&sink.rendered, 1) }
+
+func TestSetMetricsWhileRendering(t *testing.T) {
+	defer SetMetrics(nil)
+	AddHandler("metrics_race", func() string { return "h" })
+
+	var wait sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for index := 0; index < 100; index++ {
+				tpl, _ := Open([]byte(`<!-- handler: metrics_race -->`))
+				tpl.Out()
+			}
+		}()
+	}
+	for index := 0; index < 100; index++ {
+		SetMetrics(&countingSink{})
+	}
+	wait.Wait()
+
+	sink := &countingSink{}
+	SetMetrics(sink)
+	tpl, _ := Open([]byte(`<!-- handler: metrics_race -->`))
+	tpl.Out()
+	if sink.opened != 1 || sink.handlers != 1 || sink.rendered != 1 {
+		t.Errorf("got %d opened, %d handlers, %d renders, want 1 each", sink.opened, sink.handlers, sink.rendered)
+	}
+}
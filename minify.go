@@ -0,0 +1,44 @@
+package gtpl
+
+import (
+	"strings"
+)
+
+// Shrink HTML by removing comments and collapsing every run of whitespace,
+// including the runs between tags, to a single space. Conditional comments
+// and the content of pre, textarea, script and style elements are kept as is.
+func minify(content string) string {
+	content = outsideRaw(content, func(text string) string {
+		text = stripComments(text)
+		return compile(`\s+`).ReplaceAllString(text, " ")
+	})
+	return strings.TrimSpace(content)
+}
+
+// Remove HTML comments other than conditional comments like <!--[if IE]>
+func stripComments(content string) string {
+	return compile(`(?s)<!--.*?-->`).ReplaceAllStringFunc(content, func(comment string) string {
+		if strings.HasPrefix(comment, "<!--[") {
+			return comment
+		}
+		return ""
+	})
+}
+
+// Run fn over the parts of the content outside of elements whose content
+// must be kept verbatim
+func outsideRaw(content string, fn func(string) string) string {
+	raw_pattern := compile(`(?is)<pre\b.*?</pre\s*>|<textarea\b.*?</textarea\s*>|<script\b.*?</script\s*>|<style\b.*?</style\s*>`)
+
+	var results strings.Builder
+	last_index := 0
+
+	for _, match := range raw_pattern.FindAllStringIndex(content, -1) {
+		results.WriteString(fn(content[last_index:match[0]]))
+		results.WriteString(content[match[0]:match[1]])
+		last_index = match[1]
+	}
+
+	results.WriteString(fn(content[last_index:]))
+	return results.String()
+}
@@ -0,0 +1,72 @@
+package gtpl
+
+import (
+	"time"
+)
+
+// Time spent rendering a template, collected while profiling is enabled.
+// Durations add up over every call, a block parsed ten times reports the time
+// of all ten parses.
+type ProfileReport struct {
+	// Time spent in Parse() per block name, handlers run by the parse included
+	Blocks map[string]time.Duration
+
+	// Time spent in each handler
+	Handlers map[string]time.Duration
+
+	// Time spent in Out()
+	Out time.Duration
+}
+
+// Record render timings for Profile(). Enabling it again starts a new report.
+func (tpl *TPL) SetProfile(enabled bool) {
+	tpl.profile = nil
+	if enabled {
+		tpl.profile = &ProfileReport{
+			Blocks:   make(map[string]time.Duration),
+			Handlers: make(map[string]time.Duration),
+		}
+	}
+}
+
+// The timings recorded since profiling was enabled
+func (tpl *TPL) Profile() ProfileReport {
+	report := ProfileReport{
+		Blocks:   make(map[string]time.Duration),
+		Handlers: make(map[string]time.Duration),
+	}
+	if tpl.profile == nil {
+		return report
+	}
+
+	for name, duration := range tpl.profile.Blocks {
+		report.Blocks[name] = duration
+	}
+	for name, duration := range tpl.profile.Handlers {
+		report.Handlers[name] = duration
+	}
+	report.Out = tpl.profile.Out
+
+	return report
+}
+
+// Add the time since started to a block
+func (tpl *TPL) profileBlock(block_name string, started time.Time) {
+	if tpl.profile != nil {
+		tpl.profile.Blocks[block_name] += time.Since(started)
+	}
+}
+
+// Add the time since started to a handler
+func (tpl *TPL) profileHandler(handler_name string, started time.Time) {
+	if tpl.profile != nil {
+		tpl.profile.Handlers[handler_name] += time.Since(started)
+	}
+}
+
+// Add the time since started to Out()
+func (tpl *TPL) profileOut(started time.Time) {
+	if tpl.profile != nil {
+		tpl.profile.Out += time.Since(started)
+	}
+}
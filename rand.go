@@ -0,0 +1,58 @@
+package gtpl
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// The random numbers templates use unless they're given their own, shared by
+// every template and safe to use from several goroutines
+var shared_rand = rand.New(&lockedSource{source: rand.NewSource(time.Now().UnixNano()).(rand.Source64)})
+
+// A rand.Source that can be used from several goroutines
+type lockedSource struct {
+	source rand.Source64
+	mutex  sync.Mutex
+}
+
+func (locked *lockedSource) Int63() int64 {
+	locked.mutex.Lock()
+	defer locked.mutex.Unlock()
+	return locked.source.Int63()
+}
+
+func (locked *lockedSource) Uint64() uint64 {
+	locked.mutex.Lock()
+	defer locked.mutex.Unlock()
+	return locked.source.Uint64()
+}
+
+func (locked *lockedSource) Seed(seed int64) {
+	locked.mutex.Lock()
+	defer locked.mutex.Unlock()
+	locked.source.Seed(seed)
+}
+
+// The random numbers for handlers of this template to use, so a template
+// given a seed renders the same output every time, for golden file tests.
+// Context handlers get it with tpl.Rand(). Without SetSeed() or SetRand() it's
+// a source shared by all templates.
+func (tpl *TPL) Rand() *rand.Rand {
+	if tpl.random == nil {
+		return shared_rand
+	}
+	return tpl.random
+}
+
+// Give the template its own random numbers starting from seed
+func (tpl *TPL) SetSeed(seed int64) {
+	tpl.random = rand.New(rand.NewSource(seed))
+}
+
+// Give the template a rand.Rand of your own, nil goes back to the shared one.
+// It's only used by this template's render, so it doesn't need to be safe for
+// concurrent use unless handlers share it.
+func (tpl *TPL) SetRand(random *rand.Rand) {
+	tpl.random = random
+}
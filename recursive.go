@@ -0,0 +1,79 @@
+package gtpl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A node of hierarchical data, such as a comment in a thread or an entry in a
+// nav menu, rendered with ParseRecursive()
+type TreeNode interface {
+	Children() []TreeNode
+}
+
+// Parse a block once for every node of a tree, like Parse(). Each node's
+// variables come from bind and the rendered children of the node fill the
+// {children} variable, so the block places its own nested copies:
+//
+//	<!-- block: item --><li>{title}<ul>{children}</ul></li><!-- /block: item -->
+//
+// Trees nested deeper than blocks may nest return ErrMaxDepthExceeded. With
+// RootBlock the rendered tree takes the place of the root content.
+func (tpl *TPL) ParseRecursive(block_name string, root TreeNode, bind func(TreeNode) map[string]string) error {
+	if tpl.aborted != nil {
+		return tpl.aborted
+	}
+
+	tpl.setup()
+
+	key := blockKey(block_name)
+	if _, ok := tpl.blocks[key]; !ok {
+		return fmt.Errorf("%w: %s", ErrBlockNotFound, block_name)
+	}
+
+	content_results, err := tpl.renderTree(block_name, root, bind, 0)
+	if err != nil {
+		return err
+	}
+	if tpl.aborted != nil {
+		return tpl.aborted
+	}
+
+	if block_name == RootBlock {
+		tpl.blocks[key] = content_results
+		return nil
+	}
+
+	// Place the rendered tree in the parent, the same as Parse() would
+	parent_block_name := key[:strings.LastIndex(key, ".")]
+	tpl.blocks[parent_block_name] = strings.Replace(tpl.blocks[parent_block_name], placeHolder(key), tpl.markSource(key, content_results+placeHolder(key)), 1)
+	tpl.markParsed(key)
+
+	return nil
+}
+
+// Render the block for a node after rendering the blocks of its children
+func (tpl *TPL) renderTree(block_name string, node TreeNode, bind func(TreeNode) map[string]string, depth int) (string, error) {
+	if tpl.aborted != nil {
+		return "", tpl.aborted
+	}
+	if depth >= max_block_depth {
+		return "", fmt.Errorf("%w: tree nested more than %d deep at %s", ErrMaxDepthExceeded, max_block_depth, block_name)
+	}
+
+	var children strings.Builder
+	for _, child := range node.Children() {
+		content, err := tpl.renderTree(block_name, child, bind, depth+1)
+		if err != nil {
+			return "", err
+		}
+		children.WriteString(content)
+	}
+
+	tpl.AssignMany(bind(node))
+
+	// Already rendered and sanitized, so it goes in as is
+	tpl.LocalAssignments["children"] = children.String()
+
+	return tpl.renderBlock(block_name)
+}
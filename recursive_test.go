@@ -0,0 +1,69 @@
+package gtpl
+
+import (
+	"errors"
+	"testing"
+)
+
+type testNode struct {
+	title    string
+	children []*testNode
+}
+
+func (node *testNode) Children() []TreeNode {
+	children := make([]TreeNode, len(node.children))
+	for index, child := range node.children {
+		children[index] = child
+	}
+	return children
+}
+
+func bindTestNode(node TreeNode) map[string]string {
+	return map[string]string{"title": node.(*testNode).title}
+}
+
+var testTree = &testNode{title: "a", children: []*testNode{
+	{title: "b", children: []*testNode{{title: "c"}}},
+	{title: "d"},
+}}
+
+func TestParseRecursive(t *testing.T) {
+	tpl, _ := Open([]byte(`<ul><!-- block: item --><li>{title}<ul>{children}</ul></li><!-- /block: item --></ul>`))
+	if err := tpl.ParseRecursive("item", testTree, bindTestNode); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `<ul><li>a<ul><li>b<ul><li>c<ul></ul></li></ul></li><li>d<ul></ul></li></ul></li></ul>`
+	if got := tpl.Out(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseRecursiveRoot(t *testing.T) {
+	tpl, _ := Open([]byte(`[{title}{children}]`))
+	if err := tpl.ParseRecursive(RootBlock, testTree, bindTestNode); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `[a[b[c]][d]]`
+	if got := tpl.Out(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseRecursiveAborted(t *testing.T) {
+	failed := errors.New("stop")
+	tpl := &TPL{}
+	tpl.Abort(failed)
+
+	if err := tpl.ParseRecursive("item", testTree, bindTestNode); !errors.Is(err, failed) {
+		t.Errorf("ParseRecursive() = %v, want the abort error", err)
+	}
+}
+
+func TestParseRecursiveZeroTPL(t *testing.T) {
+	tpl := &TPL{}
+	if err := tpl.ParseRecursive("item", testTree, bindTestNode); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("ParseRecursive() = %v, want ErrBlockNotFound", err)
+	}
+}
@@ -0,0 +1,75 @@
+package gtpl
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Returned when a template opened in sandbox mode has a directive the sandbox
+// doesn't allow.
+var ErrSandboxed = errors.New("gtpl: directive not allowed in sandbox")
+
+// Only substitute variables and call allowed handlers
+var sandbox = false
+var sandbox_mutex sync.RWMutex
+
+// Handlers that may be called in sandbox mode
+var allowed_handlers = make(map[string]bool)
+var allowed_handlers_mutex sync.RWMutex
+
+// Restrict templates to variables, conditionals and the handlers named with
+// AllowHandler(), for templates written by end users. While it's on, opening
+// a template with include or block directives fails with ErrSandboxed, so no
+// file outside the template is ever read, and other handlers render as
+// nothing without running, the default handler included. It applies to every
+// template, like SetSafeDefault(), so turn it on in processes that render
+// user templates rather than switching it per template.
+func SetSandbox(enabled bool) {
+	sandbox_mutex.Lock()
+	defer sandbox_mutex.Unlock()
+	sandbox = enabled
+}
+
+// Report whether sandbox mode is on
+func sandboxed() bool {
+	sandbox_mutex.RLock()
+	defer sandbox_mutex.RUnlock()
+	return sandbox
+}
+
+// Allow a handler to be called by templates in sandbox mode
+func AllowHandler(name string) {
+	allowed_handlers_mutex.Lock()
+	defer allowed_handlers_mutex.Unlock()
+	allowed_handlers[name] = true
+}
+
+// Reject content with include or block directives in sandbox mode
+func sandboxCheck(content string) error {
+	if !sandboxed() {
+		return nil
+	}
+
+	if match := includePattern().FindStringSubmatch(content); match != nil {
+		return fmt.Errorf("%w: include of %s", ErrSandboxed, match[1])
+	}
+
+	for _, match := range directivePattern().FindAllStringSubmatch(content, -1) {
+		if match[3] == "block" {
+			return fmt.Errorf("%w: block %s", ErrSandboxed, match[4])
+		}
+	}
+	return nil
+}
+
+// Report whether a handler may run, which is always outside of sandbox mode
+func handlerAllowed(handler_name string) bool {
+	if !sandboxed() {
+		return true
+	}
+
+	allowed_handlers_mutex.RLock()
+	defer allowed_handlers_mutex.RUnlock()
+	return allowed_handlers[handler_name]
+}
@@ -0,0 +1,79 @@
+package gtpl
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSetSandboxWhileRendering(t *testing.T) {
+	defer SetSandbox(false)
+	AddHandler("sandbox_race", func() string { return "h" })
+
+	var wait sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for index := 0; index < 100; index++ {
+				tpl, _ := Open([]byte(`{v}<!-- handler: sandbox_race -->`))
+				tpl.Assign("v", "x")
+				tpl.Parse(RootBlock)
+				tpl.Out()
+			}
+		}()
+	}
+	for index := 0; index < 100; index++ {
+		SetSandbox(index%2 == 0)
+	}
+	wait.Wait()
+}
+
+func TestSandbox(t *testing.T) {
+	AddHandler("sandbox_allowed", func() string { return "allowed" })
+	AddHandler("sandbox_denied", func() string { return "denied" })
+	AllowHandler("sandbox_allowed")
+
+	default_called := false
+	SetDefaultHandler(func(name string) string {
+		default_called = true
+		return "default"
+	})
+	defer SetDefaultHandler(nil)
+
+	tpl, err := Open([]byte(`<p>{v}</p>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetSandbox(true)
+	defer SetSandbox(false)
+
+	for _, source := range []string{
+		`<!-- block: row -->x<!-- /block: row -->`,
+		`<!-- include: page.html -->`,
+	} {
+		if _, err := Open([]byte(source)); !errors.Is(err, ErrSandboxed) {
+			t.Errorf("Open(%q) = %v, want ErrSandboxed", source, err)
+		}
+		if _, err := OpenReader(strings.NewReader(source)); !errors.Is(err, ErrSandboxed) {
+			t.Errorf("OpenReader(%q) = %v, want ErrSandboxed", source, err)
+		}
+	}
+
+	if err := tpl.SetBlock(RootBlock, `<!-- block: row -->x<!-- /block: row -->`); !errors.Is(err, ErrSandboxed) {
+		t.Errorf("SetBlock() with a block = %v, want ErrSandboxed", err)
+	}
+
+	handlers, err := Open([]byte(`[<!-- handler: sandbox_allowed -->][<!-- handler: sandbox_denied -->][<!-- handler: sandbox_unregistered -->]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := handlers.Out(), "[allowed][][]"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if default_called {
+		t.Errorf("the default handler was called in sandbox mode")
+	}
+}
@@ -0,0 +1,198 @@
+package gtpl
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Where a part of the output came from, recorded with SetSourceMap()
+type Mapping struct {
+	// Byte offsets of the part in the output, End is exclusive
+	Start int
+	End   int
+
+	// The block that rendered the part, RootBlock for content outside of
+	// blocks. Nested blocks are named like "row.cell".
+	Block string
+
+	// The line of the template source the block starts on, 0 when it isn't
+	// known, such as for blocks from included files
+	Line int
+}
+
+// Noncharacters marking where parsed blocks start and end while a source map
+// is recorded. A start is source_map_open, the index of the block's key in
+// tpl.source_keys as hex digits counted from source_map_digit, then
+// source_map_key_end. Every mark falls between source_map_open and
+// source_map_last.
+const source_map_open = '\uFDD1'
+const source_map_key_end = '\uFDD2'
+const source_map_close = '\uFDD3'
+const source_map_digit = '\uFDE0'
+const source_map_last = '\uFDEF'
+
+// Record which block and source line every part of the output comes from,
+// read back with SourceMap() after Out(). This is for tooling such as a
+// template editor that jumps from the output to the source. Offsets are into
+// the output before comments are stripped, it's minified or the post
+// processor runs, so they only line up with Out() when none of those are set.
+func (tpl *TPL) SetSourceMap(enabled bool) {
+	tpl.source_map = enabled
+}
+
+// The parts of the last output of Out() or OutReader() in order, with the
+// block each came from. Empty unless SetSourceMap() was turned on before the
+// blocks were parsed.
+func (tpl *TPL) SourceMap() []Mapping {
+	return append([]Mapping(nil), tpl.mappings...)
+}
+
+// Wrap the content parsed into a block, up to the block's own place holder,
+// in source map marks when a source map is recorded
+func (tpl *TPL) markSource(key string, content string) string {
+	if !tpl.source_map {
+		return content
+	}
+
+	index := len(tpl.source_keys)
+	for source_index, source_key := range tpl.source_keys {
+		if source_key == key {
+			index = source_index
+			break
+		}
+	}
+	if index == len(tpl.source_keys) {
+		tpl.source_keys = append(tpl.source_keys, key)
+	}
+
+	digits := ""
+	for {
+		digits = string(source_map_digit+rune(index%16)) + digits
+		index /= 16
+		if index == 0 {
+			break
+		}
+	}
+
+	fragment := strings.TrimSuffix(content, placeHolder(key))
+	return string(source_map_open) + digits + string(source_map_key_end) + fragment + string(source_map_close) + content[len(fragment):]
+}
+
+// Remove the source map marks from content and work out the mappings they
+// describe
+func (tpl *TPL) mapSource(content string) (string, []Mapping) {
+	lines := tpl.blockLines()
+
+	var results strings.Builder
+	var mappings []Mapping
+	stack := []string{"[_GTPL_ROOT_]"}
+	start := 0
+
+	// End the part that's been written since the last mark
+	flush := func() {
+		if results.Len() > start {
+			key := stack[len(stack)-1]
+			mappings = append(mappings, Mapping{
+				Start: start,
+				End:   results.Len(),
+				Block: strings.TrimPrefix(strings.TrimPrefix(key, "[_GTPL_ROOT_]"), "."),
+				Line:  lines[key],
+			})
+		}
+		start = results.Len()
+	}
+
+	for index := 0; index < len(content); {
+		r, size := utf8.DecodeRuneInString(content[index:])
+		index += size
+
+		switch r {
+		case source_map_open:
+			flush()
+			source_index := 0
+			for index < len(content) {
+				r, size = utf8.DecodeRuneInString(content[index:])
+				index += size
+				if r == source_map_key_end {
+					break
+				}
+				source_index = source_index*16 + int(r-source_map_digit)
+			}
+			key := ""
+			if source_index < len(tpl.source_keys) {
+				key = tpl.source_keys[source_index]
+			}
+			stack = append(stack, key)
+
+		case source_map_close:
+			flush()
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+
+		default:
+			results.WriteString(content[index-size : index])
+		}
+	}
+	flush()
+
+	return results.String(), mappings
+}
+
+// The line each block's opening directive is on in the template source
+func (tpl *TPL) blockLines() map[string]int {
+	lines := map[string]int{"[_GTPL_ROOT_]": 1}
+	source := string(tpl.source)
+	stack := []string{"[_GTPL_ROOT_]"}
+
+	line, last_index := 1, 0
+	for _, match := range directivePattern().FindAllStringSubmatchIndex(source, -1) {
+		if source[match[6]:match[7]] != "block" {
+			continue
+		}
+
+		// Closing tag
+		if match[5] > match[4] {
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+
+		line += strings.Count(source[last_index:match[0]], "\n")
+		last_index = match[0]
+
+		key := stack[len(stack)-1] + "." + source[match[8]:match[9]]
+		if _, ok := lines[key]; !ok {
+			lines[key] = line
+		}
+		stack = append(stack, key)
+	}
+
+	return lines
+}
+
+// Remove every mark the package puts in content, the sanitize mark and the
+// source map marks, U+FDD0 through source_map_last
+func stripMarks(content string) string {
+	// All of them start with the same two bytes in UTF-8
+	if !strings.Contains(content, sanitize_mark[:2]) {
+		return content
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= '\uFDD0' && r <= source_map_last {
+			return -1
+		}
+		return r
+	}, content)
+}
+
+// Keep only the source map marks of content being removed
+func keepMarks(content string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= source_map_open && r <= source_map_last {
+			return r
+		}
+		return -1
+	}, content)
+}
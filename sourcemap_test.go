@@ -0,0 +1,42 @@
+package gtpl
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSourceMapMarksInValues(t *testing.T) {
+	tpl, _ := Open([]byte("<p>{v}</p>\n<!-- block: row -->[{v}]<!-- /block: row -->"))
+	tpl.SetSourceMap(true)
+
+	tpl.Assign("v", "x\uFDD1y\uFDEFz")
+	tpl.Parse("row")
+	tpl.Assign("v", "x\uFDD3y")
+	tpl.Parse(RootBlock)
+
+	want := "<p>xy</p>\n[xyz]"
+	if got := tpl.Out(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, mapping := range tpl.SourceMap() {
+		if mapping.Block != RootBlock && mapping.Block != "row" {
+			t.Errorf("mapping to unknown block %q", mapping.Block)
+		}
+	}
+}
+
+func TestSourceMapTurnedOffAfterParse(t *testing.T) {
+	tpl, _ := Open([]byte(`<ul><!-- block: row --><li>{n}</li><!-- /block: row --></ul>`))
+	tpl.SetSourceMap(true)
+	tpl.Assign("n", "1")
+	tpl.Parse("row")
+	tpl.SetSourceMap(false)
+
+	got := tpl.Out()
+	if got != "<ul><li>1</li></ul>" {
+		t.Errorf("got %q, want %q", got, "<ul><li>1</li></ul>")
+	}
+	if strings.ContainsAny(got, "\uFDD1\uFDD2\uFDD3\uFDE0") {
+		t.Errorf("source map marks left in %q", got)
+	}
+}
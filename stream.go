@@ -0,0 +1,315 @@
+package gtpl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// How much of a template is read at a time when it's streamed
+const stream_chunk_size = 64 * 1024
+
+// How long a directive may be, longer ones are taken as plain text
+const max_directive_length = 1024
+
+// Splits a streamed template into blocks as it's read, keeping only the
+// blocks themselves and the little that's needed to find the next directive
+type streamScanner struct {
+	tpl *TPL
+
+	// The open blocks, the root first
+	stack []*streamBlock
+
+	// Drop whitespace at the start of the next text, for a trailing trim marker
+	skip_space bool
+
+	// The current line, for errors
+	line int
+
+	// The marks starting the includes with arguments being read, outermost
+	// first, and the start of one that's only partly read
+	args         []string
+	args_partial string
+}
+
+// A block being read
+type streamBlock struct {
+	key     string
+	name    string
+	line    int
+	content bytes.Buffer
+
+	// How many includes with arguments it's in
+	args int
+}
+
+// Parse a template from a reader without reading all of it into memory
+// first. Blocks are split out as the content arrives, which keeps the peak
+// memory of multi-megabyte templates close to the size of the source itself.
+// The source is kept as it's read for Source() and source map line numbers.
+func loadStream(name string, r io.Reader) (tpl TPL, err error) {
+	defer func() { metricsOpened(err) }()
+	tpl.setup()
+
+	var source bytes.Buffer
+	defer func() { tpl.source = source.Bytes() }()
+	r = io.TeeReader(r, &source)
+
+	scanner := &streamScanner{
+		tpl:   &tpl,
+		stack: []*streamBlock{{key: "[_GTPL_ROOT_]"}},
+		line:  1,
+	}
+
+	if err := scanner.scan(r, true); err != nil {
+		return tpl, fmt.Errorf("gtpl parser failure: %s: %w", name, err)
+	}
+
+	if len(scanner.stack) > 1 {
+		top := scanner.stack[len(scanner.stack)-1]
+		return tpl, fmt.Errorf("gtpl parser failure: %s: block %s opened on line %d is never closed", name, top.name, top.line)
+	}
+	tpl.blocks["[_GTPL_ROOT_]"] = escapeTemplate(scanner.stack[0].content.String())
+
+	tpl.collectWarnings(name)
+
+	return tpl, nil
+}
+
+// Read content, sending text to the open block and handling directives
+func (scanner *streamScanner) scan(r io.Reader, first bool) error {
+	chunk := make([]byte, stream_chunk_size)
+	pending := ""
+	eof := false
+
+	for !eof {
+		n, err := r.Read(chunk)
+		if err == io.EOF {
+			eof = true
+		} else if err != nil {
+			return err
+		}
+		pending += string(chunk[:n])
+
+		// Wait for enough content to tell if it starts with a byte order mark
+		if first {
+			if len(pending) < 3 && !eof {
+				continue
+			}
+			pending = string(stripBOM([]byte(pending)))
+			first = false
+		}
+
+		pending, err = scanner.process(pending, eof)
+		if err != nil {
+			return err
+		}
+	}
+
+	scanner.text(pending)
+	return nil
+}
+
+// Handle every complete directive in pending and return what has to wait for
+// more content
+func (scanner *streamScanner) process(pending string, eof bool) (string, error) {
+	for {
+		index := strings.Index(pending, directive_prefix)
+		if index < 0 {
+			if eof {
+				scanner.text(pending)
+				return "", nil
+			}
+
+			// The end could be the start of a prefix
+			keep := len(directive_prefix) - 1
+			if keep > len(pending) {
+				keep = len(pending)
+			}
+			scanner.text(pending[:len(pending)-keep])
+			return pending[len(pending)-keep:], nil
+		}
+
+		scanner.text(pending[:index])
+		pending = pending[index:]
+
+		end := strings.Index(pending[len(directive_prefix):], "-->")
+		if end < 0 && !eof && len(pending) <= max_directive_length {
+			return pending, nil
+		}
+		if end < 0 || end > max_directive_length {
+			// Not a directive, the prefix is just text
+			scanner.text(directive_prefix)
+			pending = pending[len(directive_prefix):]
+			continue
+		}
+		end += len(directive_prefix)
+
+		if err := scanner.directive(pending[:end+3]); err != nil {
+			return "", err
+		}
+		pending = pending[end+3:]
+	}
+}
+
+// Add text to the open block
+func (scanner *streamScanner) text(text string) {
+	if scanner.skip_space {
+		trimmed := strings.TrimLeft(text, " \t\r\n")
+		scanner.line += strings.Count(text[:len(text)-len(trimmed)], "\n")
+		text = trimmed
+		if text != "" {
+			scanner.skip_space = false
+		}
+	}
+
+	scanner.line += strings.Count(text, "\n")
+	scanner.stack[len(scanner.stack)-1].content.WriteString(text)
+	scanner.readArgs(text)
+}
+
+// Follow the includes with arguments that start and end in text, the way
+// argScopes does for rendered content
+func (scanner *streamScanner) readArgs(text string) {
+	if scanner.args_partial == "" && !strings.ContainsAny(text, string(include_args_open)+string(include_args_close)) {
+		return
+	}
+	text = scanner.args_partial + text
+	scanner.args_partial = ""
+
+	for {
+		index := strings.IndexAny(text, string(include_args_open)+string(include_args_close))
+		if index < 0 {
+			return
+		}
+
+		if strings.HasPrefix(text[index:], string(include_args_close)) {
+			if len(scanner.args) > 0 {
+				scanner.args = scanner.args[:len(scanner.args)-1]
+			}
+			text = text[index+len(string(include_args_close)):]
+			continue
+		}
+
+		end := strings.IndexRune(text[index:], include_args_end)
+		if end < 0 {
+			scanner.args_partial = text[index:]
+			return
+		}
+		end += index + len(string(include_args_end))
+		scanner.args = append(scanner.args, text[index:end])
+		text = text[end:]
+	}
+}
+
+// Handle a directive, anything other than blocks is passed on as text the way
+// it would be in a template that was read whole
+func (scanner *streamScanner) directive(directive string) error {
+	if err := sandboxCheck(directive); err != nil {
+		return err
+	}
+
+	include_pattern := compile(`^(?:` + includePattern().String() + `)$`)
+	if match := include_pattern.FindStringSubmatch(directive); match != nil {
+		return scanner.include(match[1], match[2])
+	}
+
+	match := compile(`^(?:` + directivePattern().String() + `)$`).FindStringSubmatchIndex(directive)
+	if match == nil {
+		scanner.text(directive)
+		return nil
+	}
+
+	top := scanner.stack[len(scanner.stack)-1]
+
+	// Leading trim marker
+	if match[2] >= 0 {
+		content := top.content.Bytes()
+		top.content.Truncate(len(bytes.TrimRight(content, " \t\r\n")))
+	}
+
+	keyword := directive[match[6]:match[7]]
+	name := directive[match[8]:match[9]]
+	closing := match[5] > match[4]
+	line := scanner.line
+	scanner.line += strings.Count(directive, "\n")
+
+	switch {
+	case keyword == "handler" && closing:
+		// Only opening handler directives run, a closing one stays as text
+		top.content.WriteString(directive_prefix + " /handler: " + name + " -->")
+
+	case keyword == "handler":
+		top.content.WriteString(directive_prefix + " handler: " + name + " -->")
+
+	case !closing:
+		if len(scanner.stack) > max_block_depth {
+			return fmt.Errorf("%w: blocks nested more than %d deep at %s", ErrMaxDepthExceeded, max_block_depth, name)
+		}
+		block := &streamBlock{key: top.key + "." + name, name: name, line: line}
+		top.content.WriteString(placeHolder(block.key))
+		scanner.stack = append(scanner.stack, block)
+
+		// The arguments of the includes the block is in still apply to it
+		block.content.WriteString(strings.Join(scanner.args, ""))
+		block.args = len(scanner.args)
+
+	case len(scanner.stack) == 1:
+		return fmt.Errorf("orphaned closing tag for block %s on line %d", name, line)
+
+	default:
+		if top.name != name {
+			return fmt.Errorf("closing tag for block %s on line %d doesn't close the open block %q", name, line, top.name)
+		}
+		scanner.stack = scanner.stack[:len(scanner.stack)-1]
+		top.content.WriteString(strings.Repeat(string(include_args_close), top.args))
+
+		// Blocks repeated under the same name all use the first one's content
+		if _, ok := scanner.tpl.blocks[top.key]; !ok {
+			scanner.tpl.blocks[top.key] = escapeTemplate(top.content.String())
+		}
+	}
+
+	// Trailing trim marker
+	if match[10] >= 0 {
+		scanner.skip_space = true
+	}
+	return nil
+}
+
+// Scan an included file in place of its directive
+func (scanner *streamScanner) include(filename string, args string) error {
+	fbuffer, err := readTemplate(nil, filename)
+	if err != nil {
+		return err
+	}
+
+	included, err := include(nil, string(stripBOM(fbuffer)), 1)
+	if err != nil {
+		return err
+	}
+	if err := validateInclude(filename, included); err != nil {
+		return err
+	}
+
+	// Lines in the included file don't count for the template's line numbers
+	line := scanner.line
+	defer func() { scanner.line = line }()
+
+	header := argsHeader(args)
+	if header == "" {
+		return scanner.scan(strings.NewReader(included), false)
+	}
+
+	// Written around the content directly, so a trailing trim marker before
+	// the include still trims the included content
+	scanner.stack[len(scanner.stack)-1].content.WriteString(header)
+	scanner.readArgs(header)
+	if err := scanner.scan(strings.NewReader(included), false); err != nil {
+		return err
+	}
+	scanner.stack[len(scanner.stack)-1].content.WriteString(string(include_args_close))
+	scanner.readArgs(string(include_args_close))
+	return nil
+}
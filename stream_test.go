@@ -0,0 +1,53 @@
+package gtpl
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOpenReaderMatchesOpen(t *testing.T) {
+	AddHandler("stream_parity", func() string { return "H" })
+
+	source := []byte("<p>{title}</p>\n" +
+		"a <!-- handler: stream_parity --> b <!-- /handler: stream_parity --> c\n" +
+		"a <!--- handler: stream_parity ---> b <!--- /handler: stream_parity ---> c\n" +
+		"<ul>\n<!-- block: row --><li>{n}</li>\n<!-- /block: row --></ul>\n")
+
+	opened, err := Open(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed, err := OpenReader(bytes.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(streamed.Source(), opened.Source()) {
+		t.Errorf("OpenReader: Source() = %q, want %q", streamed.Source(), opened.Source())
+	}
+
+	render := func(tpl *TPL) (string, []Mapping) {
+		tpl.SetSourceMap(true)
+		for _, n := range []string{"1", "2"} {
+			tpl.Assign("n", n)
+			tpl.Parse("row")
+		}
+		tpl.Assign("title", "T")
+		tpl.Parse(RootBlock)
+		return tpl.Out(), tpl.SourceMap()
+	}
+	want, want_mappings := render(&opened)
+	got, got_mappings := render(&streamed)
+
+	if got != want {
+		t.Errorf("OpenReader: Out() = %q, want %q", got, want)
+	}
+	if !strings.Contains(got, "<!-- /handler: stream_parity -->") {
+		t.Errorf("closing handler directive didn't stay as text: %q", got)
+	}
+	if !reflect.DeepEqual(got_mappings, want_mappings) {
+		t.Errorf("OpenReader: SourceMap() = %+v, want %+v", got_mappings, want_mappings)
+	}
+}
@@ -0,0 +1,148 @@
+package gtpl
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A block in the structure of a template, as returned by ParseTree. Offsets
+// are byte offsets into the source that was parsed.
+type Node struct {
+	// Name of the block, empty for the root node
+	Name string
+
+	// Span of the whole block, directives included
+	Start int
+	End   int
+
+	// Span of the block's content between its directives
+	ContentStart int
+	ContentEnd   int
+
+	// Blocks nested directly in this block
+	Children []*Node
+
+	// Variable and handler names used directly in this block, not counting
+	// the ones inside child blocks. Escaped tokens like {\foo} are left out.
+	Variables []string
+	Handlers  []string
+}
+
+// Parse the structure of a template without rendering anything. This is
+// meant for tooling such as editors that want to highlight blocks, variables
+// and handlers using the same rules gtpl renders with.
+func ParseTree(source []byte) (*Node, error) {
+	content := string(source)
+	root := &Node{End: len(content), ContentEnd: len(content)}
+	stack := []*Node{root}
+
+	for _, match := range directivePattern().FindAllStringSubmatchIndex(content, -1) {
+		top := stack[len(stack)-1]
+		keyword := content[match[6]:match[7]]
+		name := content[match[8]:match[9]]
+
+		switch {
+		case keyword == "handler":
+			// Handlers are collected with the variables
+
+		case match[5] == match[4]:
+			// Opening a block
+			node := &Node{Name: name, Start: match[0], ContentStart: match[1]}
+			top.Children = append(top.Children, node)
+			stack = append(stack, node)
+
+		default:
+			// Closing a block
+			if top == root || top.Name != name {
+				return nil, fmt.Errorf("unexpected closing tag for block %s on line %d", name, lineNumber(content, match[0]))
+			}
+			top.ContentEnd = match[0]
+			top.End = match[1]
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	if len(stack) > 1 {
+		top := stack[len(stack)-1]
+		return nil, fmt.Errorf("block %s opened on line %d is never closed", top.Name, lineNumber(content, top.Start))
+	}
+
+	collectNames(root, content)
+
+	return root, nil
+}
+
+// Fill in the variables and handlers used by a node and its children
+func collectNames(node *Node, content string) {
+	offset := node.ContentStart
+	for _, child := range node.Children {
+		node.addNames(content[offset:child.Start])
+		collectNames(child, content)
+		offset = child.End
+	}
+	node.addNames(content[offset:node.ContentEnd])
+}
+
+// Add the variables and handlers used in text, plain and filtered tokens,
+// conditionals and handler directives of either syntax
+func (node *Node) addNames(text string) {
+	variable_pattern := compile(`\{([A-Za-z0-9_\-\.]+)(?:\|[^{}]*)?\}`)
+	if_pattern := compile(regexp.QuoteMeta(directive_prefix) + `\s*if\s*:\s*([A-Za-z0-9_\-\.]+)\s*-->`)
+
+	for _, match := range variable_pattern.FindAllStringSubmatch(text, -1) {
+		node.Variables = appendUnique(node.Variables, match[1])
+	}
+	for _, match := range if_pattern.FindAllStringSubmatch(text, -1) {
+		node.Variables = appendUnique(node.Variables, match[1])
+	}
+	for _, match := range handlerPattern().FindAllStringSubmatchIndex(text, -1) {
+		node.Handlers = appendUnique(node.Handlers, handlerName(text, match))
+	}
+}
+
+// Append a name unless it's already in the list
+func appendUnique(names []string, name string) []string {
+	for _, existing := range names {
+		if existing == name {
+			return names
+		}
+	}
+	return append(names, name)
+}
+
+// The 1 based line number of a byte offset
+func lineNumber(content string, offset int) int {
+	return strings.Count(content[:offset], "\n") + 1
+}
+
+// An indented outline of the template's blocks, one block per line with
+// nested blocks indented under their parent, for documenting how a template
+// is put together. Blocks at the same level are listed alphabetically.
+func (tpl *TPL) Tree() string {
+	children := make(map[string][]string)
+	for key := range tpl.blocks {
+		if key == "[_GTPL_ROOT_]" {
+			continue
+		}
+		cut_index := strings.LastIndex(key, ".")
+		children[key[:cut_index]] = append(children[key[:cut_index]], key)
+	}
+
+	var results strings.Builder
+	var walk func(parent string, depth int)
+	walk = func(parent string, depth int) {
+		keys := children[parent]
+		sort.Strings(keys)
+		for _, key := range keys {
+			results.WriteString(strings.Repeat("  ", depth))
+			results.WriteString(key[strings.LastIndex(key, ".")+1:])
+			results.WriteString("\n")
+			walk(key, depth+1)
+		}
+	}
+	walk("[_GTPL_ROOT_]", 0)
+
+	return results.String()
+}
@@ -0,0 +1,36 @@
+package gtpl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTreeNames(t *testing.T) {
+	source := `{title}<!-- handler: button label="{label}" -->` +
+		`<!-- block: row --><!-- if: shown -->{n|number}<!-- /if --><!-- handler: h | attr -->{\escaped}<!-- /block: row -->`
+
+	root, err := ParseTree([]byte(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(root.Children) != 1 {
+		t.Fatalf("got %d children, want 1", len(root.Children))
+	}
+	row := root.Children[0]
+
+	tests := []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{"root variables", root.Variables, []string{"title", "label"}},
+		{"root handlers", root.Handlers, []string{"button"}},
+		{"row variables", row.Variables, []string{"n", "shown"}},
+		{"row handlers", row.Handlers, []string{"h"}},
+	}
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.got, test.want) {
+			t.Errorf("%s = %q, want %q", test.name, test.got, test.want)
+		}
+	}
+}
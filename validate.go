@@ -0,0 +1,123 @@
+package gtpl
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Check a template for structural mistakes the block parser would otherwise
+// let through, such as closing tags without an opener which would end up
+// visible in the rendered page, blocks closed out of order or blocks that are
+// never closed. Each problem is reported with the lines around it.
+func validate(content string) error {
+	// The blocks still open, innermost last
+	type openBlock struct {
+		name   string
+		offset int
+	}
+	var opened []openBlock
+	var problems []string
+
+	for _, match := range directivePattern().FindAllStringSubmatchIndex(content, -1) {
+		if content[match[6]:match[7]] != "block" {
+			continue
+		}
+		name := content[match[8]:match[9]]
+
+		// Opening tag
+		if match[5] == match[4] {
+			opened = append(opened, openBlock{name, match[0]})
+			continue
+		}
+
+		index := len(opened) - 1
+		for index >= 0 && opened[index].name != name {
+			index--
+		}
+
+		switch {
+		case index < 0:
+			problems = append(problems, fmt.Sprintf("orphaned closing tag for block %s on line %d:\n%s", name, lineNumber(content, match[0]), snippet(content, match[0])))
+			continue
+		case index < len(opened)-1:
+			problems = append(problems, fmt.Sprintf("closing tag for block %s on line %d doesn't close the open block %q:\n%s", name, lineNumber(content, match[0]), opened[len(opened)-1].name, snippet(content, match[0])))
+		}
+
+		// Blocks it crossed stay open, so their own closing tags still match
+		opened = append(opened[:index], opened[index+1:]...)
+	}
+
+	for _, block := range opened {
+		problems = append(problems, fmt.Sprintf("block %s opened on line %d is never closed:\n%s", block.name, lineNumber(content, block.offset), snippet(content, block.offset)))
+	}
+
+	if problems != nil {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// The line holding offset with the lines around it, numbered and with the
+// line itself marked, to show where in a template a problem is
+func snippet(content string, offset int) string {
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	line := lineNumber(content, offset)
+
+	first, last := line-1, line+1
+	if first < 1 {
+		first = 1
+	}
+	if last > len(lines) {
+		last = len(lines)
+	}
+	width := len(strconv.Itoa(last))
+
+	var results strings.Builder
+	for number := first; number <= last; number++ {
+		marker := "  "
+		if number == line {
+			marker = "> "
+		}
+		fmt.Fprintf(&results, "%s%*d | %s\n", marker, width, number, strings.TrimRight(lines[number-1], "\r"))
+	}
+	return strings.TrimRight(results.String(), "\n")
+}
+
+// Check that an included file closes every block it opens and closes no block
+// it didn't open. Blocks spanning an include would only work by accident of
+// where the file happens to be included.
+func validateInclude(filename string, content string) error {
+	opened := make(map[string][]int)
+
+	for _, match := range directivePattern().FindAllStringSubmatchIndex(content, -1) {
+		if content[match[6]:match[7]] != "block" {
+			continue
+		}
+		name := content[match[8]:match[9]]
+
+		// Opening tag
+		if match[5] == match[4] {
+			opened[name] = append(opened[name], match[0])
+			continue
+		}
+
+		if len(opened[name]) == 0 {
+			return fmt.Errorf("included file %s closes block %s on line %d, which it doesn't open:\n%s", filename, name, lineNumber(content, match[0]), snippet(content, match[0]))
+		}
+		opened[name] = opened[name][:len(opened[name])-1]
+	}
+
+	// Report the first unclosed block in the file
+	unclosed, first := "", len(content)
+	for name, offsets := range opened {
+		if len(offsets) > 0 && offsets[0] < first {
+			unclosed, first = name, offsets[0]
+		}
+	}
+	if unclosed != "" {
+		return fmt.Errorf("included file %s opens block %s on line %d without closing it:\n%s", filename, unclosed, lineNumber(content, first), snippet(content, first))
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package gtpl
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateLinesBelowInclude(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "five.html"), []byte("1\n2\n3\n4\n5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	SetTemplateDir(dir)
+	defer SetTemplateDir("")
+
+	_, err := Open([]byte("<!-- include: five.html -->\nline 2\nline 3\n<!-- /block: a -->\nline 5\n"))
+	if err == nil {
+		t.Fatal("orphaned closing tag wasn't reported")
+	}
+	if !strings.Contains(err.Error(), "on line 4") || !strings.Contains(err.Error(), "> 4 | <!-- /block: a -->") {
+		t.Errorf("error doesn't point at line 4 of the source:\n%v", err)
+	}
+}
+
+func TestValidateCrossedBlocks(t *testing.T) {
+	source := "<!-- block: a -->\n<!-- block: b -->\n<!-- /block: a -->\n<!-- /block: b -->\n"
+
+	_, opened := Open([]byte(source))
+	_, streamed := OpenReader(strings.NewReader(source))
+	for name, err := range map[string]error{"Open": opened, "OpenReader": streamed} {
+		if err == nil {
+			t.Errorf("%s: crossed blocks weren't reported", name)
+			continue
+		}
+		if !strings.Contains(err.Error(), "closing tag for block a on line 3 doesn't close the open block \"b\"") {
+			t.Errorf("%s: error doesn't report the crossed closing tag:\n%v", name, err)
+		}
+	}
+	if err := opened; err != nil && !strings.Contains(err.Error(), "> 3 | <!-- /block: a -->") {
+		t.Errorf("Open: error doesn't show the lines around it:\n%v", err)
+	}
+}